@@ -0,0 +1,118 @@
+package check
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+// bucket of the store holding callbacks which arrived before
+// their task reached check
+const callbackBucket = "callbacks"
+
+// how long callbacks of unknown tasks are kept, the tasks of older
+// ones are not expected to reach check anymore
+const callbackRetention = 24 * time.Hour
+
+// callback stored until its task reaches check
+type storedCallback struct {
+	Callback *lib.Callback
+	Received time.Time
+}
+
+// httpCallback receives the completion notifications of services.
+// The task is checked right away, the check stays authoritative.
+func (c *cCtx) httpCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/callback/")
+	if !c.ValidCallbackToken(token) {
+		http.NotFound(w, r)
+		return
+	}
+
+	cb := &lib.Callback{}
+	if err := json.NewDecoder(r.Body).Decode(cb); err != nil {
+		http.Error(w, "could not decode callback: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !c.Scheduler.notify(token, cb) {
+		// the task is still on its way from feed, or it ended already
+		// and the callback is pruned eventually
+		if err := c.Store.Put(callbackBucket, token, &storedCallback{cb, time.Now()}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		c.pruneCallbacks()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notify schedules the task of token for an immediate check and
+// reports whether the task is known.
+func (s *scheduler) notify(token string, cb *lib.Callback) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	t, ok := s.tasks[s.tokens[token]]
+	if !ok {
+		return false
+	}
+
+	s.c.Debug.Println("Task", t.Req.TaskID, "of", t.Req.Service, "notified completion")
+	t.Callback = cb
+	t.NextCheck = time.Now()
+	t.notified = t.busy
+	return true
+}
+
+// pendingCallback applies a callback which arrived before t was
+// added. Must be called with the mutex held.
+func (s *scheduler) pendingCallback(t *task) {
+	stored := &storedCallback{}
+	found, err := s.c.Store.Get(callbackBucket, t.Req.CallbackToken, stored)
+	if err != nil {
+		s.c.Warning.Println("Could not load callback of", t.Key+":", err.Error())
+		return
+	}
+
+	if !found || stored.Callback == nil {
+		return
+	}
+
+	t.Callback = stored.Callback
+	t.NextCheck = time.Now()
+
+	if err := s.c.Store.Delete(callbackBucket, t.Req.CallbackToken); err != nil {
+		s.c.Warning.Println("Could not remove callback of", t.Key+":", err.Error())
+	}
+}
+
+// pruneCallbacks removes stored callbacks older than the retention.
+func (c *cCtx) pruneCallbacks() {
+	old := []string{}
+
+	c.Store.ForEach(callbackBucket, func(key string, value []byte) error {
+		stored := &storedCallback{}
+		if err := json.Unmarshal(value, stored); err != nil || time.Since(stored.Received) > callbackRetention {
+			old = append(old, key)
+		}
+
+		return nil
+	})
+
+	for _, key := range old {
+		if err := c.Store.Delete(callbackBucket, key); err != nil {
+			c.Warning.Println("Could not remove callback:", err.Error())
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package check
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+func callbackToken(c *cCtx, nonce string) string {
+	return nonce + "." + c.Sign("callback", nonce)
+}
+
+func newCallbackTask(token string) *lib.InternalRequest {
+	return &lib.InternalRequest{
+		Service:         "cuckoo",
+		URL:             "http://sandbox-1:8080",
+		TaskID:          token[:4],
+		Started:         time.Now(),
+		CallbackToken:   token,
+		OriginalRequest: &lib.ExternalRequest{},
+	}
+}
+
+func TestHTTPCallback(t *testing.T) {
+	c := newTestContext(t, &lib.Config{SigningKey: "secret"})
+
+	known := callbackToken(c, "aaaa")
+	if err := c.Scheduler.add(newCallbackTask(known)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		status int
+	}{
+		{"wrong method", "GET", known, `{"Done": true}`, http.StatusMethodNotAllowed},
+		{"forged token", "POST", "aaaa.forged", `{"Done": true}`, http.StatusNotFound},
+		{"malformed", "POST", known, `{"Done": `, http.StatusBadRequest},
+		{"known task", "POST", known, `{"Done": true}`, http.StatusNoContent},
+		{"unknown task", "POST", callbackToken(c, "bbbb"), `{"Error": "crashed"}`, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c.httpCallback(w, httptest.NewRequest(tt.method, "/callback/"+tt.token, strings.NewReader(tt.body)))
+
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, w.Code)
+		}
+	}
+
+	// the known task is checked right away
+	notified := c.Scheduler.tasks[newCallbackTask(known).Key()]
+	if notified.Callback == nil || !notified.Callback.Done || notified.NextCheck.After(time.Now()) {
+		t.Errorf("expected the known task to be notified, got %+v", notified)
+	}
+
+	// the callback of the unknown task waits for its task
+	unknown := callbackToken(c, "bbbb")
+	if err := c.Scheduler.add(newCallbackTask(unknown)); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := c.Scheduler.tasks[newCallbackTask(unknown).Key()]
+	if pending.Callback == nil || pending.Callback.Error != "crashed" {
+		t.Errorf("expected the stored callback to be applied, got %+v", pending.Callback)
+	}
+
+	if found, _ := c.Store.Get(callbackBucket, unknown, &storedCallback{}); found {
+		t.Error("expected the applied callback to be removed from the store")
+	}
+}
+
+func TestPruneCallbacks(t *testing.T) {
+	c := newTestContext(t, &lib.Config{})
+
+	stored := map[string]time.Time{
+		"fresh": time.Now().Add(-time.Hour),
+		"old":   time.Now().Add(-callbackRetention - time.Hour),
+	}
+	for token, received := range stored {
+		if err := c.Store.Put(callbackBucket, token, &storedCallback{&lib.Callback{Done: true}, received}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Store.Put(callbackBucket, "legacy", &lib.Callback{Done: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.pruneCallbacks()
+
+	for token, kept := range map[string]bool{"fresh": true, "old": false, "legacy": false} {
+		if found, _ := c.Store.Get(callbackBucket, token, &storedCallback{}); found != kept {
+			t.Errorf("expected %s to be kept: %t", token, kept)
+		}
+	}
+}
@@ -3,7 +3,8 @@ package check
 import (
 	"encoding/json"
 	"errors"
-	"sync"
+	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
@@ -15,34 +16,49 @@ import (
 type cCtx struct {
 	*lib.Ctx
 
-	Producer *lib.QueueHandler // the queue read by submit
+	Producer  *lib.QueueHandler // the queue read by submit
+	Feeder    *lib.QueueHandler // the work item queue of feed, used to re-feed timed out tasks
+	Scheduler *scheduler
 }
 
-// elemt of the watch map
-type watchElem struct {
-	Req     *lib.InternalRequest
-	Msg     *amqp.Delivery
-	Service *lib.Service
-}
-
-var (
-	watchMap      = make(map[string]*watchElem)
-	watchMapMutex = &sync.Mutex{}
-)
+// bucket of the store holding the tasks watched by check
+const taskBucket = "check"
 
 // Run starts the check module either blocking or non-blocking.
 func Run(ctx *lib.Ctx, blocking bool) error {
-	producer, err := ctx.SetupQueue("totem-dynamic-submit-" + ctx.Config.QueueSuffix)
+	producer, err := ctx.SetupConfirmedQueue("totem-dynamic-submit-" + ctx.Config.QueueSuffix)
+	if err != nil {
+		return err
+	}
+
+	feeder, err := ctx.SetupConfirmedQueue("totem-dynamic-feed-" + ctx.Config.QueueSuffix)
 	if err != nil {
 		return err
 	}
 
 	c := &cCtx{
-		ctx,
-		producer,
+		Ctx:      ctx,
+		Producer: producer,
+		Feeder:   feeder,
+	}
+
+	c.Scheduler = newScheduler(c)
+	if err := c.Scheduler.load(); err != nil {
+		return err
+	}
+	c.pruneCallbacks()
+
+	if c.Mux != nil {
+		if ctx.Config.AdminToken != "" {
+			c.Mux.HandleFunc("/tasks/", c.httpTasks)
+		}
+		c.Mux.HandleFunc("/callback/", c.httpCallback)
 	}
 
-	go c.checkLoop()
+	c.HandleCancel(c.Scheduler.cancel)
+	c.ReferenceFiles(c.Scheduler.files)
+
+	go c.Scheduler.run()
 	if blocking {
 		c.Consume("totem-dynamic-check-"+ctx.Config.QueueSuffix, ctx.Config.CheckPrefetchCount, c.parseMsg)
 	} else {
@@ -54,7 +70,8 @@ func Run(ctx *lib.Ctx, blocking bool) error {
 
 // parseMsg accepts an *amqp.Delivery and parses the body assuming
 // it's a request from feed. On success the parsed struct is
-// added to the watchMap.
+// handed to the scheduler, which persists it, and the message
+// is acked right away.
 func (c *cCtx) parseMsg(msg amqp.Delivery) {
 	req := &lib.InternalRequest{}
 	err := json.Unmarshal(msg.Body, req)
@@ -67,62 +84,220 @@ func (c *cCtx) parseMsg(msg amqp.Delivery) {
 	//	return
 	//}
 
-	watchMapMutex.Lock()
-	watchMap[req.FilePath] = &watchElem{
-		Req: req,
-		Msg: &msg,
-		Service: &lib.Service{
-			Name:   req.Service,
-			URL:    req.URL,
-			Client: c.Client,
-		},
-	}
-	watchMapMutex.Unlock()
+	err = c.Scheduler.add(req)
+	if c.NackOnError(err, "Could not store task!", &msg) {
+		return
+	}
+
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
+	}
 }
 
-// checkLoop loops over the watch map and checks if the
-// task is done or if an error occured and if so sends
-// the task to submit or the failed queue.
-func (c *cCtx) checkLoop() {
-	waitDuration := time.Second * time.Duration(c.Config.WaitBetweenRequests)
+// checkTask evaluates the status check and checkErr fetched from
+// the service and if the task is done or an error occured sends the
+// task to submit or the failed queue. Tasks running longer than
+// allowed are timed out. The returned bool tells if the task reached
+// an end and can be removed, the state is the one observed, last if
+// nothing was observed. A failure notified by the service through
+// cb ends the task unless the service reports it as done.
+func (c *cCtx) checkTask(req *lib.InternalRequest, last *lib.TaskState, cb *lib.Callback, check *lib.CheckTask, checkErr error) (bool, *lib.TaskState) {
+	if req.OriginalRequest.Expired() {
+		c.ExpireTask(req, nil)
+		return true, last
+	}
 
-	for {
-		time.Sleep(waitDuration) //This is here so an empty list does not result in full load
+	if cr := c.Cancelled(req.OriginalRequest, req.Service, req.SampleHashes()...); cr != nil {
+		c.CancelTask(req, cr, nil)
+		return true, last
+	}
 
-		for k, v := range watchMap {
-			time.Sleep(waitDuration)
+	internalReq, err := json.Marshal(req)
+	if c.fail(err, "Could not create internalRequest!", req, nil) {
+		return true, last
+	}
 
-			// try to get task status
-			check, err := v.Service.CheckTask(v.Req.TaskID)
-			if c.NackOnError(err, "Couldn't get status of task!", v.Msg) {
-				delete(watchMap, k)
-				continue
-			}
+	// the service could not be asked, e.g. because it is restarting,
+	// so the task is checked again later unless it took too long
+	if checkErr != nil {
+		c.Warning.Println("Couldn't get status of task", req.TaskID, "at", req.URL+", checking again later:", checkErr.Error())
 
-			// if an error occured, remove from map and nack
-			if check.Error != "" {
-				c.NackOnError(errors.New(check.Error), "Checking task returned an error!", v.Msg)
-				delete(watchMap, k)
-				continue
+		if max := c.maxAnalysisDuration(req.Service); max > 0 && time.Since(req.Started) > max {
+			state := &lib.TaskState{State: lib.StateSubmitted, Message: "status unknown, " + checkErr.Error(), Time: time.Now()}
+			if last != nil {
+				state.State = last.State
+				state.Progress = last.Progress
 			}
 
-			// if task is not done continue to next task
-			if !check.Done {
-				continue
-			}
+			c.timeout(req, internalReq, max, state)
+			return true, state
+		}
 
-			// task is done, send it to submit
-			internalReq, err := json.Marshal(v.Req)
-			if c.NackOnError(err, "Could not create internalRequest!", v.Msg) {
-				return
-			}
+		return false, last
+	}
 
-			c.Producer.Send(internalReq)
-			if err := v.Msg.Ack(false); err != nil {
-				c.Warning.Println("Sending ACK failed!", err.Error())
-			}
+	if check == nil {
+		c.fail(errors.New("Task "+req.TaskID+" is missing in the batch check"), "Couldn't get status of task!", req, internalReq)
+		return true, last
+	}
+
+	state := check.TaskState()
+
+	// if an error occured, remove the task and fail
+	if check.Error != "" {
+		c.fail(errors.New(check.Error), "Checking task returned an error!", req, internalReq)
+		return true, state
+	}
+
+	if !check.Done && state.State == lib.StateFailed {
+		c.fail(errors.New("Task failed: "+state.Message), "Service reported a failed task!", req, internalReq)
+		return true, state
+	}
+
+	if !check.Done && cb != nil && cb.Error != "" {
+		c.fail(errors.New(cb.Error), "Service notified a failed task!", req, internalReq)
+		return true, &lib.TaskState{State: lib.StateFailed, Message: cb.Error, Time: time.Now()}
+	}
+
+	// if task is not done check again later, unless it took too long
+	if !check.Done {
+		if max := c.maxAnalysisDuration(req.Service); max > 0 && time.Since(req.Started) > max {
+			c.timeout(req, internalReq, max, state)
+			return true, state
+		}
+
+		return false, state
+	}
+
+	// task is done, send it to submit together with the final state
+	done := *req
+	done.States = append(append([]lib.TaskState{}, req.States...), *state)
+
+	internalReq, err = json.Marshal(done)
+	if c.fail(err, "Could not create internalRequest!", req, nil) {
+		return true, state
+	}
+
+	err = c.Producer.Send(internalReq)
+	if err != nil {
+		// keep it and try again next round
+		c.Warning.Println("Could not send task to submit:", err.Error())
+		return false, state
+	}
+
+	return true, state
+}
+
+// maxAnalysisDuration returns how long tasks of service may run,
+// 0 means unlimited.
+func (c *cCtx) maxAnalysisDuration(service string) time.Duration {
+	return time.Second * time.Duration(c.Config.MaxAnalysisDuration[service])
+}
+
+// timeout ends a task which exceeded the maximum analysis duration
+// of its service. The task is cancelled at the service and, if
+// enabled, fed once more to another URL of the service. Otherwise
+// it is failed together with the last observed status.
+func (c *cCtx) timeout(req *lib.InternalRequest, internalReq []byte, max time.Duration, state *lib.TaskState) {
+	reason := fmt.Sprintf("analysis exceeded %s, last status: %s", max, state.State)
+	if state.Progress > 0 {
+		reason += fmt.Sprintf(" (%d%%)", state.Progress)
+	}
+
+	if state.Message != "" {
+		reason += ", " + state.Message
+	}
+
+	outcome, outcomeReason := c.StopTask(lib.OutcomeTimedOut, reason, req)
+
+	if c.Config.RefeedOnTimeout && !req.Refed {
+		err := c.refeed(req)
+		if err == nil {
+			c.Info.Println("Task", req.TaskID, "at", req.URL, "timed out after", max, "and was fed again")
+			return
+		}
+
+		c.Warning.Println("Could not feed timed out task", req.TaskID, "again:", err.Error())
+	}
+
+	c.RemoveFile(req.SamplePath())
+
+	c.FailOnError(errors.New(reason), "Task timed out!", "totem-dynamic-check-"+c.Config.QueueSuffix, internalReq)
+	c.ReportOutcome(outcome, outcomeReason, req)
+}
+
+// fail works like FailOnError for the task, which ended, and removes
+// its sample.
+func (c *cCtx) fail(err error, desc string, req *lib.InternalRequest, internalReq []byte) bool {
+	if !c.FailOnError(err, desc, "totem-dynamic-check-"+c.Config.QueueSuffix, internalReq) {
+		return false
+	}
+
+	c.RemoveFile(req.SamplePath())
+	return true
+}
 
-			delete(watchMap, k)
+// refeed publishes the sample of a timed out task as a new work
+// item for feed, excluding the URL it timed out at.
+func (c *cCtx) refeed(req *lib.InternalRequest) error {
+	others := 0
+	for _, u := range c.Services()[req.Service] {
+		if u != req.URL {
+			others++
 		}
 	}
+
+	if others == 0 {
+		return errors.New(req.Service + " has no other URLs")
+	}
+
+	feedReq := &lib.FeedRequest{
+		Service:         req.Service,
+		FileType:        req.FileType,
+		Options:         req.Options,
+		Parent:          req.Parent,
+		ObjectType:      req.ObjectType,
+		Hashes:          req.Hashes,
+		NormalizedURL:   req.NormalizedURL,
+		URLHash:         req.URLHash,
+		ExcludeURLs:     []string{req.URL},
+		Refed:           true,
+		OriginalRequest: req.OriginalRequest,
+	}
+
+	if req.OriginalRequest.Download {
+		feedReq.LocalPath = "/tmp/" + req.FilePath
+	}
+
+	feedReqJ, err := json.Marshal(feedReq)
+	if err != nil {
+		return err
+	}
+
+	// the claim is renewed for the new work item, so the janitor
+	// keeps the sample while it waits in the feed queue
+	if err := c.HandOverFile(feedReq.LocalPath); err != nil {
+		return err
+	}
+
+	return c.Feeder.Send(feedReqJ)
+}
+
+// httpTasks lists all tasks currently watched by check, callback
+// tokens, archive passwords and sample URIs are left out.
+func (c *cCtx) httpTasks(w http.ResponseWriter, r *http.Request) {
+	if !lib.Authorized(r, c.Config.AdminToken) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	tasks := c.Scheduler.snapshot()
+	for i := range tasks {
+		req := tasks[i].Req
+		req.CallbackToken = ""
+		req.OriginalRequest = req.OriginalRequest.Redacted()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
 }
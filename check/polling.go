@@ -0,0 +1,148 @@
+package check
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+// bucket of the store holding the learned task durations per service
+const durationBucket = "durations"
+
+// weight of the latest completion in the learned duration
+const learnWeight = 0.2
+
+// completions needed before the learned duration is used
+const learnMinSamples = 3
+
+// expected duration of the tasks of a service, learned from
+// completed tasks as exponentially weighted moving average
+type duration struct {
+	Seconds float64
+	Samples int
+}
+
+// loadDurations reads the learned durations from the store. Must
+// be called with the mutex held.
+func (s *scheduler) loadDurations() error {
+	return s.c.Store.ForEach(durationBucket, func(key string, value []byte) error {
+		d := &duration{}
+		if err := json.Unmarshal(value, d); err != nil {
+			return err
+		}
+
+		s.durations[key] = d
+		return nil
+	})
+}
+
+// policy returns the polling policy of service with all unset
+// values filled in. Without a configured policy tasks are checked
+// every WaitBetweenRequests seconds.
+func (s *scheduler) policy(service string) lib.PollingPolicy {
+	p := lib.PollingPolicy{}
+	if configured, ok := s.c.Config.Polling[service]; ok && configured != nil {
+		p = *configured
+	}
+
+	if p.MinInterval <= 0 {
+		p.MinInterval = int(s.interval / time.Second)
+	}
+
+	if p.MaxInterval < p.MinInterval {
+		p.MaxInterval = p.MinInterval
+	}
+
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = p.MinInterval
+	}
+
+	if p.Backoff < 1 {
+		p.Backoff = 1
+	}
+
+	return p
+}
+
+// expected returns how long tasks of service usually take. Must be
+// called with the mutex held.
+func (s *scheduler) expected(service string, p lib.PollingPolicy) time.Duration {
+	if d, ok := s.durations[service]; p.Learn && ok && d.Samples >= learnMinSamples {
+		return time.Duration(d.Seconds * float64(time.Second))
+	}
+
+	return time.Second * time.Duration(p.InitialDelay)
+}
+
+// nextCheck schedules the next check of t. Tasks younger than the
+// expected duration are checked rarely, but not later than the
+// expected completion. Afterwards the interval starts at the
+// minimum and grows by the backoff factor up to the maximum. Tasks
+// of services which notify their completion are only polled as
+// fallback until they did. The check is never scheduled after the
+// deadline of the task or the end of its maximum analysis duration.
+// Must be called with the mutex held.
+func (s *scheduler) nextCheck(t *task, now time.Time) {
+	p := s.policy(t.Req.Service)
+	max := time.Second * time.Duration(p.MaxInterval)
+
+	var wait time.Duration
+	if due := t.Req.Started.Add(s.expected(t.Req.Service, p)); now.Before(due) {
+		wait = due.Sub(now)
+		if wait > max {
+			wait = max
+		}
+	} else {
+		wait = time.Duration(float64(p.MinInterval) * math.Pow(p.Backoff, float64(t.Polls)) * float64(time.Second))
+		if wait > max || wait <= 0 {
+			wait = max
+		}
+
+		t.Polls++
+	}
+
+	if t.Req.CallbackToken != "" && t.Callback == nil && wait < s.callbackFallback {
+		wait = s.callbackFallback
+	}
+
+	// expired and overlong tasks are ended when they are checked, so
+	// the check must not come later than that
+	next := now.Add(wait)
+	ends := []time.Time{t.Req.OriginalRequest.Deadline}
+	if max := s.c.maxAnalysisDuration(t.Req.Service); max > 0 {
+		ends = append(ends, t.Req.Started.Add(max))
+	}
+
+	for _, end := range ends {
+		if !end.IsZero() && end.After(now) && end.Before(next) {
+			next = end
+		}
+	}
+
+	t.NextCheck = next
+}
+
+// learn updates the expected duration of the service of a completed
+// task. Must be called with the mutex held.
+func (s *scheduler) learn(req *lib.InternalRequest) {
+	if req.Started.IsZero() {
+		return
+	}
+
+	took := time.Since(req.Started).Seconds()
+
+	d, ok := s.durations[req.Service]
+	if !ok {
+		d = &duration{Seconds: took}
+		s.durations[req.Service] = d
+	}
+
+	d.Seconds = (1-learnWeight)*d.Seconds + learnWeight*took
+	d.Samples++
+
+	if err := s.c.Store.Put(durationBucket, req.Service, d); err != nil {
+		s.c.Warning.Println("Could not store duration of", req.Service+":", err.Error())
+	}
+}
@@ -0,0 +1,111 @@
+package check
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+func TestNextCheck(t *testing.T) {
+	now := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	policy := &lib.PollingPolicy{InitialDelay: 300, MinInterval: 30, MaxInterval: 600, Backoff: 2}
+
+	c := newTestContext(t, &lib.Config{
+		WaitBetweenRequests: 10,
+		Polling: map[string]*lib.PollingPolicy{
+			"cuckoo":  policy,
+			"limited": policy,
+			"slow":    {InitialDelay: 3600, MinInterval: 30, MaxInterval: 600, Backoff: 2},
+		},
+		MaxAnalysisDuration: map[string]int{"limited": 420},
+	})
+
+	tests := []struct {
+		name     string
+		service  string
+		started  time.Duration // offset from now
+		polls    int
+		token    string
+		callback *lib.Callback
+		deadline time.Duration // offset from now, none if 0
+		wait     time.Duration
+		newPolls int
+	}{
+		{"young", "cuckoo", -100 * time.Second, 0, "", nil, 0, 200 * time.Second, 0},
+		{"young capped", "slow", 0, 0, "", nil, 0, 600 * time.Second, 0},
+		{"due", "cuckoo", -400 * time.Second, 0, "", nil, 0, 30 * time.Second, 1},
+		{"backoff", "cuckoo", -400 * time.Second, 2, "", nil, 0, 120 * time.Second, 3},
+		{"backoff capped", "cuckoo", -400 * time.Second, 10, "", nil, 0, 600 * time.Second, 11},
+		{"no policy", "other", -20 * time.Second, 0, "", nil, 0, 10 * time.Second, 1},
+		{"callback fallback", "cuckoo", -400 * time.Second, 0, "token", nil, 0, 600 * time.Second, 1},
+		{"callback received", "cuckoo", -400 * time.Second, 0, "token", &lib.Callback{}, 0, 30 * time.Second, 1},
+		{"deadline", "cuckoo", -400 * time.Second, 0, "", nil, 10 * time.Second, 10 * time.Second, 1},
+		{"deadline passed", "cuckoo", -400 * time.Second, 0, "", nil, -10 * time.Second, 30 * time.Second, 1},
+		{"max analysis duration", "limited", -415 * time.Second, 0, "", nil, 0, 5 * time.Second, 1},
+	}
+
+	for _, tt := range tests {
+		req := &lib.InternalRequest{
+			Service:         tt.service,
+			Started:         now.Add(tt.started),
+			CallbackToken:   tt.token,
+			OriginalRequest: &lib.ExternalRequest{},
+		}
+		if tt.deadline != 0 {
+			req.OriginalRequest.Deadline = now.Add(tt.deadline)
+		}
+
+		task := &task{Req: req, Polls: tt.polls, Callback: tt.callback}
+		c.Scheduler.nextCheck(task, now)
+
+		if wait := task.NextCheck.Sub(now); wait != tt.wait {
+			t.Errorf("%s: expected a wait of %s, got %s", tt.name, tt.wait, wait)
+		}
+
+		if task.Polls != tt.newPolls {
+			t.Errorf("%s: expected %d polls, got %d", tt.name, tt.newPolls, task.Polls)
+		}
+	}
+}
+
+func TestLearn(t *testing.T) {
+	policy := &lib.PollingPolicy{InitialDelay: 300, Learn: true}
+	c := newTestContext(t, &lib.Config{Polling: map[string]*lib.PollingPolicy{"cuckoo": policy}})
+	s := c.Scheduler
+	p := s.policy("cuckoo")
+
+	// tasks without a start are not learned from
+	s.learn(&lib.InternalRequest{Service: "cuckoo"})
+	if _, ok := s.durations["cuckoo"]; ok {
+		t.Error("expected nothing to be learned from a task without a start")
+	}
+
+	for i := 1; i <= learnMinSamples; i++ {
+		if expected := s.expected("cuckoo", p); expected != 300*time.Second {
+			t.Errorf("expected the initial delay with %d samples, got %s", i-1, expected)
+		}
+
+		s.learn(&lib.InternalRequest{Service: "cuckoo", Started: time.Now().Add(-100 * time.Second)})
+	}
+
+	if expected := s.expected("cuckoo", p); math.Abs(expected.Seconds()-100) > 1 {
+		t.Errorf("expected the learned duration of 100s, got %s", expected)
+	}
+
+	// without learning the initial delay is used anyway
+	if expected := s.expected("cuckoo", lib.PollingPolicy{InitialDelay: 300}); expected != 300*time.Second {
+		t.Errorf("expected the initial delay if learning is disabled, got %s", expected)
+	}
+
+	// a restarted scheduler continues with the learned duration
+	restarted := newScheduler(c)
+	if err := restarted.loadDurations(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := restarted.durations["cuckoo"]; d == nil || d.Samples != learnMinSamples {
+		t.Errorf("expected %d stored samples, got %+v", learnMinSamples, d)
+	}
+}
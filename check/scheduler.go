@@ -0,0 +1,390 @@
+package check
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+// task watched by the scheduler
+type task struct {
+	Key       string
+	Req       *lib.InternalRequest
+	NextCheck time.Time
+	State     *lib.TaskState // last observed state
+	Polls     int            // checks since the task reached its expected duration
+	Callback  *lib.Callback  // completion notified by the service
+
+	busy     bool // handed to a worker right now
+	notified bool // an immediate check was asked for while busy
+}
+
+// scheduler keeps track of all tasks of check, keyed by service,
+// URL and task ID, and hands the ones which are due to the worker
+// pool of their service. The store is the durable copy of the
+// tasks, the scheduler only holds them in memory for scheduling.
+type scheduler struct {
+	c *cCtx
+
+	mutex  sync.Mutex
+	tasks  map[string]*task
+	tokens map[string]string // callback token to task key
+	pools  map[string]chan []*task
+
+	// URLs without batch checks and when that was detected
+	unbatched map[string]time.Time
+
+	durations map[string]*duration
+
+	workers          int
+	batchSize        int
+	interval         time.Duration
+	callbackFallback time.Duration
+}
+
+func newScheduler(c *cCtx) *scheduler {
+	workers := c.Config.CheckWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+
+	batchSize := c.Config.CheckBatchSize
+	if batchSize <= 0 {
+		batchSize = 50
+	}
+
+	callbackFallback := c.Config.CallbackFallbackInterval
+	if callbackFallback <= 0 {
+		callbackFallback = 600
+	}
+
+	return &scheduler{
+		c:         c,
+		tasks:     make(map[string]*task),
+		tokens:    make(map[string]string),
+		pools:     make(map[string]chan []*task),
+		unbatched: make(map[string]time.Time),
+		durations: make(map[string]*duration),
+		workers:   workers,
+		batchSize: batchSize,
+		interval:  time.Second * time.Duration(c.Config.WaitBetweenRequests),
+
+		callbackFallback: time.Second * time.Duration(callbackFallback),
+	}
+}
+
+// load adds all tasks and learned durations from the store, so
+// checking resumes where it stopped before a restart.
+func (s *scheduler) load() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.loadDurations(); err != nil {
+		return err
+	}
+
+	err := s.c.Store.ForEach(taskBucket, func(key string, value []byte) error {
+		req := &lib.InternalRequest{}
+		if err := json.Unmarshal(value, req); err != nil {
+			return err
+		}
+
+		s.tasks[key] = &task{Key: key, Req: req, NextCheck: time.Now(), State: lastState(req)}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the store can't be modified while iterating
+	for key, t := range s.tasks {
+		if t.Req.CallbackToken != "" {
+			s.tokens[t.Req.CallbackToken] = key
+			s.pendingCallback(t)
+		}
+	}
+
+	return nil
+}
+
+// add persists a new task and schedules its first check.
+func (s *scheduler) add(req *lib.InternalRequest) error {
+	key := req.Key()
+	if err := s.c.Store.Put(taskBucket, key, req); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.tasks[key]; !exists {
+		t := &task{Key: key, Req: req, State: lastState(req)}
+		s.nextCheck(t, time.Now())
+		s.tasks[key] = t
+
+		if req.CallbackToken != "" {
+			s.tokens[req.CallbackToken] = key
+			s.pendingCallback(t)
+		}
+	}
+
+	return nil
+}
+
+// finish is called by the workers after a task was checked. Changes
+// of the state are published as events, transitions to another state
+// are recorded in the task. Tasks which reached an end are removed,
+// all others are rescheduled.
+func (s *scheduler) finish(t *task, remove bool, state *lib.TaskState) {
+	if remove {
+		if err := s.c.Store.Delete(taskBucket, t.Key); err != nil {
+			s.c.Warning.Println("Could not remove task", t.Key, "from the store:", err.Error())
+		}
+	}
+
+	s.mutex.Lock()
+
+	publish := state != t.State && changed(t.State, state)
+	previous := ""
+	if t.State != nil {
+		previous = t.State.State
+	}
+
+	if publish {
+		if previous != state.State {
+			t.Req.States = append(t.Req.States, *state)
+			if !remove {
+				if err := s.c.Store.Put(taskBucket, t.Key, t.Req); err != nil {
+					s.c.Warning.Println("Could not store state of task", t.Key+":", err.Error())
+				}
+			}
+		}
+
+		t.State = state
+	}
+
+	if remove {
+		if state != nil && state.State == lib.StateDone {
+			s.learn(t.Req)
+		}
+
+		delete(s.tasks, t.Key)
+		delete(s.tokens, t.Req.CallbackToken)
+	} else {
+		t.busy = false
+		s.nextCheck(t, time.Now())
+
+		// a callback or cancel arrived during the check
+		if t.notified {
+			t.notified = false
+			t.NextCheck = time.Now()
+		}
+	}
+
+	s.mutex.Unlock()
+
+	// publishing might block, so it is done without the mutex
+	if publish {
+		s.c.PublishEvent(t.Req, previous, state)
+	}
+}
+
+// lastState returns the last recorded state of req.
+func lastState(req *lib.InternalRequest) *lib.TaskState {
+	if len(req.States) == 0 {
+		return nil
+	}
+
+	return &req.States[len(req.States)-1]
+}
+
+// changed reports if the state, progress or message differ.
+func changed(old, new *lib.TaskState) bool {
+	if new == nil {
+		return false
+	}
+
+	return old == nil || old.State != new.State || old.Progress != new.Progress || old.Message != new.Message
+}
+
+// run periodically hands all due tasks to the pools of their
+// services, the tasks of a URL are grouped into batches if the
+// service supports batch checks. It never blocks on a pool, tasks
+// whose pool is busy are simply tried again on the next tick.
+func (s *scheduler) run() {
+	for {
+		time.Sleep(time.Second)
+
+		now := time.Now()
+
+		s.mutex.Lock()
+		due := make(map[string][]*task)
+		for _, t := range s.tasks {
+			if t.busy || now.Before(t.NextCheck) {
+				continue
+			}
+
+			// don't occupy workers with rate limited URLs
+			if s.c.NewService(t.Req.Service, t.Req.URL).Delay() > 0 {
+				continue
+			}
+
+			due[t.Req.URL] = append(due[t.Req.URL], t)
+		}
+
+		for serviceURL, tasks := range due {
+			size := s.batchSize
+			if detected, ok := s.unbatched[serviceURL]; ok && now.Sub(detected) < time.Hour {
+				size = 1
+			}
+
+			for len(tasks) > 0 {
+				n := size
+				if n > len(tasks) {
+					n = len(tasks)
+				}
+
+				select {
+				case s.pool(tasks[0].Req.Service) <- tasks[:n]:
+					for _, t := range tasks[:n] {
+						t.busy = true
+					}
+				default:
+				}
+
+				tasks = tasks[n:]
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// pool returns the job queue of a service and starts its workers
+// on first use. Must be called with the mutex held.
+func (s *scheduler) pool(service string) chan []*task {
+	jobs, ok := s.pools[service]
+	if !ok {
+		jobs = make(chan []*task, s.workers)
+		s.pools[service] = jobs
+
+		for i := 0; i < s.workers; i++ {
+			go s.worker(jobs)
+		}
+	}
+
+	return jobs
+}
+
+func (s *scheduler) worker(jobs chan []*task) {
+	for batch := range jobs {
+		checks, errs := s.fetch(batch)
+
+		for _, t := range batch {
+			s.mutex.Lock()
+			cb := t.Callback
+			s.mutex.Unlock()
+
+			remove, state := s.c.checkTask(t.Req, t.State, cb, checks[t.Req.TaskID], errs[t.Req.TaskID])
+			s.finish(t, remove, state)
+		}
+	}
+}
+
+// fetch gets the status of all tasks of a batch, which share the
+// same service URL. If the service turns out to not support batch
+// checks the tasks are checked one by one and the URL is no longer
+// batched for a while. Errors which kept the service from being
+// asked are returned by task ID, the tasks are checked again later
+// then. Errors the service reports for a task are part of its check.
+func (s *scheduler) fetch(batch []*task) (map[string]*lib.CheckTask, map[string]error) {
+	service := s.c.NewService(batch[0].Req.Service, batch[0].Req.URL)
+	errs := make(map[string]error)
+
+	if len(batch) > 1 && s.c.ServiceSupports(service.Name, service.URL, lib.FeatureBatchCheck) {
+		taskIDs := make([]string, len(batch))
+		for i, t := range batch {
+			taskIDs[i] = t.Req.TaskID
+		}
+
+		checks, err := service.CheckTasks(taskIDs)
+		if err != lib.ErrBatchUnsupported {
+			if err != nil {
+				for _, taskID := range taskIDs {
+					errs[taskID] = err
+				}
+			}
+
+			return checks, errs
+		}
+
+		s.c.Info.Println(service.URL, "does not support batch checks")
+
+		s.mutex.Lock()
+		s.unbatched[service.URL] = time.Now()
+		s.mutex.Unlock()
+	}
+
+	checks := make(map[string]*lib.CheckTask)
+	for _, t := range batch {
+		check, err := service.CheckTask(t.Req.TaskID)
+		if err != nil && check.Error == "" {
+			errs[t.Req.TaskID] = err
+			continue
+		}
+
+		checks[t.Req.TaskID] = check
+	}
+
+	return checks, errs
+}
+
+// cancel schedules all tasks referenced by cr for an immediate
+// check, which ends them.
+func (s *scheduler) cancel(cr *lib.CancelRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, t := range s.tasks {
+		if cr.Matches(t.Req.OriginalRequest, t.Req.Service, t.Req.SampleHashes()...) {
+			t.NextCheck = time.Now()
+			t.notified = t.busy
+		}
+	}
+}
+
+// files returns the samples of all scheduled tasks.
+func (s *scheduler) files() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files := []string{}
+	for _, t := range s.tasks {
+		if path := t.Req.SamplePath(); path != "" {
+			files = append(files, path)
+		}
+	}
+
+	return files
+}
+
+// snapshot returns a copy of all scheduled tasks.
+func (s *scheduler) snapshot() []task {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tasks := make([]task, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		c := *t
+
+		// the request is modified when the state changes
+		req := *t.Req
+		req.States = append([]lib.TaskState{}, t.Req.States...)
+		c.Req = &req
+
+		tasks = append(tasks, c)
+	}
+
+	return tasks
+}
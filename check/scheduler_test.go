@@ -0,0 +1,159 @@
+package check
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+func newTestContext(t *testing.T, config *lib.Config) *cCtx {
+	store, err := lib.OpenStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	discard := log.New(ioutil.Discard, "", 0)
+	c := &cCtx{Ctx: &lib.Ctx{
+		Config:  config,
+		Debug:   discard,
+		Info:    discard,
+		Warning: discard,
+		Client:  http.DefaultClient,
+		Store:   store,
+	}}
+	c.Scheduler = newScheduler(c)
+
+	return c
+}
+
+// newTestService starts a service named cuckoo announcing features.
+// Its tasks are done, failed or down depending on their ID, batch
+// checks answer with batchStatus and report all tasks as queued.
+func newTestService(t *testing.T, features []string, batchStatus int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&lib.Info{Name: "cuckoo", ProtocolVersion: lib.ProtocolVersion, Features: features})
+	})
+	mux.HandleFunc("/check/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("taskid") {
+		case "done":
+			json.NewEncoder(w).Encode(&lib.CheckTask{Done: true})
+		case "failed":
+			json.NewEncoder(w).Encode(&lib.CheckTask{Error: "analysis crashed"})
+		default:
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("/check/batch/", func(w http.ResponseWriter, r *http.Request) {
+		if batchStatus != http.StatusOK {
+			http.Error(w, "batch check failed", batchStatus)
+			return
+		}
+
+		batch := &lib.CheckBatch{Tasks: make(map[string]*lib.CheckTask)}
+		for _, taskID := range strings.Split(r.URL.Query().Get("taskids"), ",") {
+			batch.Tasks[taskID] = &lib.CheckTask{State: lib.StateQueued}
+		}
+		json.NewEncoder(w).Encode(batch)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestFetch(t *testing.T) {
+	tests := []struct {
+		name        string
+		features    []string
+		batchStatus int
+		taskIDs     []string
+		checks      map[string]string // task ID to the state of its check
+		errs        []string          // task IDs whose check is retried
+		unbatched   bool
+	}{
+		{"done", nil, http.StatusOK, []string{"done"}, map[string]string{"done": lib.StateDone}, nil, false},
+		{"service reports an error", nil, http.StatusOK, []string{"failed"}, map[string]string{"failed": lib.StateFailed}, nil, false},
+		{"service down", nil, http.StatusOK, []string{"down"}, map[string]string{}, []string{"down"}, false},
+		{"one of several down", nil, http.StatusOK, []string{"done", "down"}, map[string]string{"done": lib.StateDone}, []string{"down"}, false},
+		{"batch", []string{lib.FeatureBatchCheck}, http.StatusOK, []string{"done", "down"}, map[string]string{"done": lib.StateQueued, "down": lib.StateQueued}, nil, false},
+		{"batch fails", []string{lib.FeatureBatchCheck}, http.StatusInternalServerError, []string{"done", "down"}, nil, []string{"done", "down"}, false},
+		{"batch unsupported", []string{lib.FeatureBatchCheck}, http.StatusNotFound, []string{"done", "down"}, map[string]string{"done": lib.StateDone}, []string{"down"}, true},
+	}
+
+	for _, tt := range tests {
+		server := newTestService(t, tt.features, tt.batchStatus)
+		c := newTestContext(t, &lib.Config{})
+
+		batch := []*task{}
+		for _, taskID := range tt.taskIDs {
+			batch = append(batch, &task{Req: &lib.InternalRequest{Service: "cuckoo", URL: server.URL, TaskID: taskID}})
+		}
+
+		checks, errs := c.Scheduler.fetch(batch)
+
+		states := make(map[string]string)
+		for taskID, check := range checks {
+			states[taskID] = check.TaskState().State
+		}
+
+		if len(states) != len(tt.checks) {
+			t.Errorf("%s: expected checks %v, got %v", tt.name, tt.checks, states)
+		}
+		for taskID, state := range tt.checks {
+			if states[taskID] != state {
+				t.Errorf("%s: expected %s to be %s, got %s", tt.name, taskID, state, states[taskID])
+			}
+		}
+
+		failed := []string{}
+		for taskID := range errs {
+			failed = append(failed, taskID)
+		}
+		sort.Strings(failed)
+
+		if strings.Join(failed, ",") != strings.Join(tt.errs, ",") {
+			t.Errorf("%s: expected errors for %v, got %v", tt.name, tt.errs, failed)
+		}
+
+		if _, ok := c.Scheduler.unbatched[server.URL]; ok != tt.unbatched {
+			t.Errorf("%s: expected unbatched to be %t", tt.name, tt.unbatched)
+		}
+	}
+}
+
+func TestCheckTaskRetriesUnreachableServices(t *testing.T) {
+	server := newTestService(t, nil, http.StatusOK)
+	c := newTestContext(t, &lib.Config{})
+
+	req := &lib.InternalRequest{
+		Service:         "cuckoo",
+		URL:             server.URL,
+		TaskID:          "down",
+		Started:         time.Now(),
+		OriginalRequest: &lib.ExternalRequest{},
+	}
+	last := &lib.TaskState{State: lib.StateRunning}
+
+	checks, errs := c.Scheduler.fetch([]*task{{Req: req}})
+
+	remove, state := c.checkTask(req, last, nil, checks[req.TaskID], errs[req.TaskID])
+	if remove {
+		t.Error("a task of an unreachable service should be checked again")
+	}
+
+	if state != last {
+		t.Errorf("expected the last state to be kept, got %v", state)
+	}
+}
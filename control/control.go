@@ -0,0 +1,78 @@
+package control
+
+import (
+	"encoding/json"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+
+	"github.com/streadway/amqp"
+)
+
+type ctlCtx struct {
+	*lib.Ctx
+}
+
+// Run starts the control module either blocking or non-blocking.
+func Run(ctx *lib.Ctx, blocking bool) error {
+	c := &ctlCtx{ctx}
+
+	// registrations are only accepted with a token
+	if ctx.Config.RegistrationToken != "" {
+		if c.Mux != nil {
+			c.Mux.HandleFunc("/services/", c.httpServices)
+			c.Mux.HandleFunc("/register/", c.httpRegister)
+		}
+
+		// every node keeps its own registry
+		if ctx.Config.RegistrationExchange != "" {
+			registrationQueue := "totem-dynamic-registrations-" + ctx.Config.QueueSuffix
+			if err := c.SetupFanoutQueue(ctx.Config.RegistrationExchange, registrationQueue); err != nil {
+				return err
+			}
+
+			go c.Consume(registrationQueue, ctx.Config.ControlPrefetchCount, c.parseRegistration)
+		}
+	} else if ctx.Config.RegistrationExchange != "" {
+		c.Warning.Println("RegistrationExchange is ignored without a RegistrationToken")
+	}
+
+	// every node has to end its own tasks
+	controlQueue := "totem-dynamic-control-" + ctx.Config.QueueSuffix
+	if err := c.SetupFanoutQueue(ctx.Config.ControlExchange, controlQueue); err != nil {
+		return err
+	}
+
+	if blocking {
+		c.Consume(controlQueue, ctx.Config.ControlPrefetchCount, c.parseMsg)
+	} else {
+		go c.Consume(controlQueue, ctx.Config.ControlPrefetchCount, c.parseMsg)
+	}
+
+	return nil
+}
+
+// parseMsg accepts an *amqp.Delivery and parses the body assuming
+// it's a cancel request. On success the request is handed to all
+// modules, which end the referenced tasks they know about.
+func (c *ctlCtx) parseMsg(msg amqp.Delivery) {
+	cr := &lib.CancelRequest{}
+	err := json.Unmarshal(msg.Body, cr)
+	if c.NackOnError(err, "Could not decode json!", &msg) {
+		return
+	}
+
+	if c.NackOnError(cr.Validate(), "Could not validate cancel request", &msg) {
+		return
+	}
+
+	c.Info.Println("Received cancel request for request", cr.RequestID, "sample", cr.SHA256, "service", cr.Service)
+
+	err = c.Cancel(cr)
+	if c.NackOnError(err, "Could not store cancel request!", &msg) {
+		return
+	}
+
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
+	}
+}
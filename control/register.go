@@ -0,0 +1,82 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+
+	"github.com/streadway/amqp"
+)
+
+// parseRegistration accepts an *amqp.Delivery and parses the body
+// assuming it's a heartbeat of a service instance, which has to
+// carry the RegistrationToken. Refused heartbeats are only logged,
+// they would put the token into the failed queue otherwise.
+func (c *ctlCtx) parseRegistration(msg amqp.Delivery) {
+	reg := &lib.Registration{}
+	err := json.Unmarshal(msg.Body, reg)
+
+	if err == nil && subtle.ConstantTimeCompare([]byte(reg.Token), []byte(c.Config.RegistrationToken)) != 1 {
+		err = errors.New("invalid registration token")
+	}
+
+	if err == nil {
+		err = c.Register(reg)
+	}
+
+	if err != nil {
+		c.Warning.Println("Refused registration of", reg.Name, "at", reg.URL+":", err.Error())
+	}
+
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
+	}
+}
+
+// httpRegister receives the heartbeats of service instances, they
+// have to carry the RegistrationToken as bearer token.
+func (c *ctlCtx) httpRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !lib.Authorized(r, c.Config.RegistrationToken) {
+		http.Error(w, "invalid registration token", http.StatusUnauthorized)
+		return
+	}
+
+	reg := &lib.Registration{}
+	if err := json.NewDecoder(r.Body).Decode(reg); err != nil {
+		http.Error(w, "could not decode registration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.Register(reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// httpServices lists the URLs of all services together with the
+// live registrations, it is protected like /register/.
+func (c *ctlCtx) httpServices(w http.ResponseWriter, r *http.Request) {
+	if !lib.Authorized(r, c.Config.RegistrationToken) {
+		http.Error(w, "invalid registration token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Services      map[string][]string
+		Registrations []lib.Registration
+	}{
+		c.Services(),
+		c.Registrations(),
+	})
+}
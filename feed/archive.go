@@ -0,0 +1,561 @@
+package feed
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+var errWrongPassword = errors.New("wrong password")
+
+// a file extracted from an archive
+type archiveMember struct {
+	Path   string // the extracted file in /tmp
+	Member string // path of the file inside the archive
+}
+
+// extractor unpacks (nested) archives into /tmp while enforcing
+// the configured limits, so zip bombs can't fill up the disk.
+type extractor struct {
+	passwords      []string
+	sevenZipBinary string
+
+	maxDepth      int
+	maxMembers    int
+	maxMemberSize int64
+	maxTotalSize  int64
+
+	members []*archiveMember
+	total   int64
+}
+
+// expandArchive checks if the sample of the work item is an archive
+// and, if so, extracts it and creates a new work item for every
+// member. The returned bool tells if the sample was an archive.
+func (c *fCtx) expandArchive(feedReq *lib.FeedRequest, path string) (bool, error) {
+	kind, err := archiveType(path)
+	if err != nil || kind == "" {
+		return false, err
+	}
+
+	e := &extractor{
+		passwords:      append(feedReq.OriginalRequest.Passwords, c.Config.ArchivePasswords...),
+		sevenZipBinary: c.Config.SevenZipBinary,
+		maxDepth:       c.Config.ArchiveMaxDepth,
+		maxMembers:     c.Config.ArchiveMaxMembers,
+		maxMemberSize:  c.Config.ArchiveMaxMemberSize,
+		maxTotalSize:   c.Config.ArchiveMaxTotalSize,
+	}
+
+	if e.maxDepth <= 0 {
+		e.maxDepth = 3
+	}
+
+	if e.maxMembers <= 0 {
+		e.maxMembers = 100
+	}
+
+	if e.maxMemberSize <= 0 {
+		e.maxMemberSize = 100 * 1024 * 1024
+	}
+
+	if e.maxTotalSize <= 0 {
+		e.maxTotalSize = 512 * 1024 * 1024
+	}
+
+	err = e.expand(path, "", 0)
+	if err == nil && len(e.members) == 0 {
+		err = errors.New("archive is empty")
+	}
+
+	if err != nil {
+		e.cleanup(0)
+		return true, err
+	}
+
+	// downloaded archives were hashed already
+	if feedReq.Hashes == nil {
+		feedReq.Hashes, err = hashFile(path)
+		if err != nil {
+			e.cleanup(0)
+			return true, err
+		}
+	}
+	archiveHash := feedReq.Hashes.SHA256
+
+	c.Debug.Println("Extracted", len(e.members), "members from", feedReq.OriginalRequest.Filename)
+
+	for i, m := range e.members {
+		item, err := json.Marshal(lib.FeedRequest{
+			Service:         feedReq.Service,
+			Options:         feedReq.Options,
+			OriginalRequest: feedReq.OriginalRequest.WithoutPasswords(),
+			LocalPath:       m.Path,
+			Parent: &lib.ArchiveParent{
+				Filename: feedReq.OriginalRequest.Filename,
+				SHA256:   archiveHash,
+				Member:   m.Member,
+			},
+		})
+		if err == nil {
+			err = c.HandOverFile(m.Path)
+		}
+
+		if err == nil {
+			err = c.Splitter.Send(item)
+		}
+
+		if err != nil {
+			// the members sent so far are on their way already
+			e.cleanup(i)
+			return true, err
+		}
+	}
+
+	c.RemoveFile(path)
+	return true, nil
+}
+
+// archiveType returns the kind of archive stored at path or an
+// empty string if it is none we can expand.
+func archiveType(path string) (string, error) {
+	fileType, err := detectFileType(path)
+	if err != nil {
+		return "", err
+	}
+
+	switch fileType {
+	case "zip", "7z", "gzip", "tar":
+		return fileType, nil
+	}
+
+	return "", nil
+}
+
+// expand extracts the file at path if it is an archive or records
+// it as a member otherwise. member is the path inside of the
+// top-level archive, depth the nesting level of the file.
+func (e *extractor) expand(path, member string, depth int) error {
+	kind, err := archiveType(path)
+	if err != nil {
+		if depth > 0 {
+			os.Remove(path)
+		}
+		return err
+	}
+
+	if kind == "" {
+		if len(e.members) >= e.maxMembers {
+			os.Remove(path)
+			return errors.New("archive has more than " + strconv.Itoa(e.maxMembers) + " members")
+		}
+
+		e.members = append(e.members, &archiveMember{path, member})
+		return nil
+	}
+
+	if depth >= e.maxDepth {
+		if depth > 0 {
+			os.Remove(path)
+		}
+		return errors.New("archives are nested deeper than " + strconv.Itoa(e.maxDepth) + " levels")
+	}
+
+	switch kind {
+	case "zip":
+		err = e.zip(path, member, depth)
+	case "tar":
+		var f *os.File
+		f, err = os.Open(path)
+		if err == nil {
+			err = e.tar(f, member, depth)
+			f.Close()
+		}
+	case "gzip":
+		err = e.gzip(path, member, depth)
+	case "7z":
+		err = e.sevenZip(path, member, depth)
+	}
+
+	// nested archives are not needed anymore once they are expanded,
+	// the top-level one is removed by the caller
+	if depth > 0 {
+		os.Remove(path)
+	}
+
+	return err
+}
+
+// addMember writes r into a new file in /tmp and expands it.
+func (e *extractor) addMember(r io.Reader, member string, depth int) error {
+	limit := e.maxMemberSize
+	if rest := e.maxTotalSize - e.total; rest < limit {
+		limit = rest
+	}
+
+	tmpFile, err := ioutil.TempFile("/tmp/", "totem-dynamic")
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(tmpFile, io.LimitReader(r, limit+1))
+	tmpFile.Close()
+	if err == nil && n > limit {
+		err = errors.New(member + " exceeds the size limits")
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	e.total += n
+	return e.expand(tmpFile.Name(), member, depth+1)
+}
+
+// cleanup removes all extracted members starting at index from.
+func (e *extractor) cleanup(from int) {
+	for _, m := range e.members[from:] {
+		os.Remove(m.Path)
+	}
+}
+
+func (e *extractor) zip(path, member string, depth int) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		if f.UncompressedSize64 > uint64(e.maxMemberSize) {
+			return errors.New(f.Name + " exceeds the size limits")
+		}
+
+		err = e.zipEntry(f, member, depth)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// zipEntry extracts a single, possibly encrypted, entry of a zip.
+func (e *extractor) zipEntry(f *zip.File, member string, depth int) error {
+	if f.Flags&0x1 == 0 {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		return e.addMember(rc, joinMember(member, f.Name), depth)
+	}
+
+	password, err := e.zipPassword(f)
+	if err != nil {
+		return err
+	}
+
+	r, err := openZipCrypto(f, password)
+	if err != nil {
+		return err
+	}
+
+	return e.addMember(r, joinMember(member, f.Name), depth)
+}
+
+// zipPassword finds the password for an encrypted zip entry by
+// decrypting it completely, so the CRC can be verified.
+func (e *extractor) zipPassword(f *zip.File) (string, error) {
+	if f.Method == 99 {
+		return "", errors.New(f.Name + " is AES encrypted which is not supported")
+	}
+
+	for _, password := range e.passwords {
+		r, err := openZipCrypto(f, password)
+		if err == errWrongPassword {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(r, e.maxMemberSize+1))
+		if err == nil && n <= e.maxMemberSize {
+			return password, nil
+		}
+	}
+
+	return "", errors.New("no matching password for " + f.Name)
+}
+
+func (e *extractor) tar(r io.Reader, member string, depth int) error {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != '\x00' {
+			// no real file, might be a dir or symlink
+			continue
+		}
+
+		if hdr.Size > e.maxMemberSize {
+			return errors.New(hdr.Name + " exceeds the size limits")
+		}
+
+		err = e.addMember(tr, joinMember(member, hdr.Name), depth)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *extractor) gzip(path, member string, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	// gzip only wraps a single file, it only gets its own
+	// path component if the original name was stored
+	if gr.Name != "" {
+		member = joinMember(member, gr.Name)
+	}
+
+	return e.addMember(gr, member, depth)
+}
+
+// sevenZip expands 7z archives using the external 7z binary. The
+// listing is checked against the limits before anything is written.
+// 7z only reads passwords from its arguments or an interactive
+// prompt, so they show up in the process list while it runs.
+func (e *extractor) sevenZip(path, member string, depth int) error {
+	if e.sevenZipBinary == "" {
+		return errors.New("SevenZipBinary is not configured, can't expand 7z archives")
+	}
+
+	// the empty password covers archives without encryption
+	password, found := "", false
+	for _, p := range append([]string{""}, e.passwords...) {
+		if exec.Command(e.sevenZipBinary, "t", "-p"+p, path).Run() == nil {
+			password, found = p, true
+			break
+		}
+	}
+
+	if !found {
+		return errors.New("no matching password for 7z archive")
+	}
+
+	listing, err := exec.Command(e.sevenZipBinary, "l", "-slt", "-p"+password, path).Output()
+	if err != nil {
+		return err
+	}
+
+	count, size := parseSevenZipListing(string(listing))
+	if len(e.members)+count > e.maxMembers {
+		return errors.New("archive has more than " + strconv.Itoa(e.maxMembers) + " members")
+	}
+
+	if e.total+size > e.maxTotalSize {
+		return errors.New("7z archive exceeds the size limits")
+	}
+
+	dir, err := ioutil.TempDir("/tmp/", "totem-dynamic")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	out, err := exec.Command(e.sevenZipBinary, "x", "-y", "-p"+password, "-o"+dir, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("7z failed: %s %s", err.Error(), out)
+	}
+
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return e.addMember(f, joinMember(member, filepath.ToSlash(rel)), depth)
+	})
+}
+
+// parseSevenZipListing returns the number of files and their
+// total size from the output of "7z l -slt".
+func parseSevenZipListing(listing string) (int, int64) {
+	parts := strings.SplitN(listing, "\n----------\n", 2)
+	if len(parts) != 2 {
+		return 0, 0
+	}
+
+	count := 0
+	var size int64
+
+	for _, block := range strings.Split(parts[1], "\n\n") {
+		isFile := false
+		for _, line := range strings.Split(block, "\n") {
+			line = strings.TrimSpace(line)
+
+			if strings.HasPrefix(line, "Path = ") {
+				isFile = true
+			}
+
+			if strings.HasPrefix(line, "Attributes = D") || line == "Folder = +" {
+				isFile = false
+				break
+			}
+
+			if strings.HasPrefix(line, "Size = ") {
+				s, _ := strconv.ParseInt(strings.TrimPrefix(line, "Size = "), 10, 64)
+				size += s
+			}
+		}
+
+		if isFile {
+			count += 1
+		}
+	}
+
+	return count, size
+}
+
+func joinMember(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+
+	return parent + "/" + name
+}
+
+// zipCrypto implements the traditional PKWARE encryption which is
+// still used for most "infected" zips.
+type zipCrypto struct {
+	r          io.Reader
+	k0, k1, k2 uint32
+}
+
+// openZipCrypto returns a reader for the decrypted and decompressed
+// content of the zip entry. errWrongPassword is returned if the
+// password check in the encryption header fails. The CRC of the
+// content is verified when the reader hits EOF.
+func openZipCrypto(f *zip.File, password string) (io.Reader, error) {
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	z := &zipCrypto{raw, 0x12345678, 0x23456789, 0x34567890}
+	for _, b := range []byte(password) {
+		z.update(b)
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(z, header); err != nil {
+		return nil, err
+	}
+
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&0x8 != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+
+	if header[11] != check {
+		return nil, errWrongPassword
+	}
+
+	var r io.Reader
+	switch f.Method {
+	case zip.Store:
+		r = z
+	case zip.Deflate:
+		r = flate.NewReader(z)
+	default:
+		return nil, errors.New(f.Name + " uses an unsupported compression method")
+	}
+
+	return &crcReader{r, crc32.NewIEEE(), f.CRC32}, nil
+}
+
+func (z *zipCrypto) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	for i := 0; i < n; i++ {
+		t := (z.k2 | 2) & 0xffff
+		p[i] ^= byte((t * (t ^ 1)) >> 8)
+		z.update(p[i])
+	}
+
+	return n, err
+}
+
+func (z *zipCrypto) update(b byte) {
+	z.k0 = crc32.IEEETable[byte(z.k0)^b] ^ (z.k0 >> 8)
+	z.k1 = (z.k1+(z.k0&0xff))*134775813 + 1
+	z.k2 = crc32.IEEETable[byte(z.k2)^byte(z.k1>>24)] ^ (z.k2 >> 8)
+}
+
+// crcReader verifies the CRC32 of everything read once EOF is reached.
+type crcReader struct {
+	r    io.Reader
+	hash hash.Hash32
+	want uint32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+
+	if err == io.EOF && c.hash.Sum32() != c.want {
+		err = errors.New("checksum mismatch, wrong password or corrupt archive")
+	}
+
+	return n, err
+}
@@ -0,0 +1,255 @@
+package feed
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zip entry for the test archives, encrypted with the traditional
+// PKWARE encryption if password is set
+type zipEntry struct {
+	name     string
+	data     []byte
+	password string
+}
+
+func buildZip(t *testing.T, entries ...zipEntry) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+
+	for _, e := range entries {
+		if e.password == "" {
+			f, err := w.Create(e.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(e.data)
+			continue
+		}
+
+		crc := crc32.ChecksumIEEE(e.data)
+		f, err := w.CreateRaw(&zip.FileHeader{
+			Name:               e.name,
+			Method:             zip.Store,
+			Flags:              0x1,
+			CRC32:              crc,
+			CompressedSize64:   uint64(len(e.data) + 12),
+			UncompressedSize64: uint64(len(e.data)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		z := &zipCrypto{nil, 0x12345678, 0x23456789, 0x34567890}
+		for _, b := range []byte(e.password) {
+			z.update(b)
+		}
+
+		header := []byte("0123456789A")
+		plain := append(append(header, byte(crc>>24)), e.data...)
+		for _, b := range plain {
+			k := (z.k2 | 2) & 0xffff
+			f.Write([]byte{b ^ byte((k*(k^1))>>8)})
+			z.update(b)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func buildTarGz(t *testing.T, name string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(data)
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestExtractor(t *testing.T) {
+	sample := []byte("not an archive, just a sample")
+	inner := buildZip(t, zipEntry{"inner.txt", sample, ""})
+
+	tests := []struct {
+		name          string
+		archive       []byte
+		passwords     []string
+		maxDepth      int
+		maxMembers    int
+		maxMemberSize int64
+		maxTotalSize  int64
+		members       []string // expected member paths, nil if an error is expected
+		errorText     string
+	}{
+		{
+			name:    "plain zip",
+			archive: buildZip(t, zipEntry{"a.txt", sample, ""}, zipEntry{"b.txt", sample, ""}),
+			members: []string{"a.txt", "b.txt"},
+		},
+		{
+			name:      "encrypted zip with the right password",
+			archive:   buildZip(t, zipEntry{"mal.exe", sample, "infected"}),
+			passwords: []string{"wrong", "infected"},
+			members:   []string{"mal.exe"},
+		},
+		{
+			name:      "encrypted zip with the wrong passwords",
+			archive:   buildZip(t, zipEntry{"mal.exe", sample, "infected"}),
+			passwords: []string{"wrong", "also wrong"},
+			errorText: "no matching password",
+		},
+		{
+			name:      "encrypted zip without passwords",
+			archive:   buildZip(t, zipEntry{"mal.exe", sample, "infected"}),
+			errorText: "no matching password",
+		},
+		{
+			name:    "nested zip",
+			archive: buildZip(t, zipEntry{"outer.txt", sample, ""}, zipEntry{"inner.zip", inner, ""}),
+			members: []string{"outer.txt", "inner.zip/inner.txt"},
+		},
+		{
+			name:      "nested too deep",
+			archive:   buildZip(t, zipEntry{"inner.zip", inner, ""}),
+			maxDepth:  1,
+			errorText: "nested deeper",
+		},
+		{
+			name:    "tar.gz",
+			archive: buildTarGz(t, "dir/sample.bin", sample),
+			// the decompressed tar counts against the limits as well
+			maxMemberSize: 16384,
+			maxTotalSize:  32768,
+			members:       []string{"dir/sample.bin"},
+		},
+		{
+			name:       "too many members",
+			archive:    buildZip(t, zipEntry{"a.txt", sample, ""}, zipEntry{"b.txt", sample, ""}, zipEntry{"c.txt", sample, ""}),
+			maxMembers: 2,
+			errorText:  "more than 2 members",
+		},
+		{
+			name:          "member too large",
+			archive:       buildZip(t, zipEntry{"a.txt", sample, ""}),
+			maxMemberSize: int64(len(sample) - 1),
+			errorText:     "exceeds the size limits",
+		},
+		{
+			name:          "encrypted member too large",
+			archive:       buildZip(t, zipEntry{"a.txt", sample, "infected"}),
+			passwords:     []string{"infected"},
+			maxMemberSize: int64(len(sample) - 1),
+			errorText:     "exceeds the size limits",
+		},
+		{
+			name:         "archive too large in total",
+			archive:      buildZip(t, zipEntry{"a.txt", sample, ""}, zipEntry{"b.txt", sample, ""}),
+			maxTotalSize: int64(len(sample) + 1),
+			errorText:    "exceeds the size limits",
+		},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "archive")
+		if err := ioutil.WriteFile(path, tt.archive, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		e := &extractor{
+			passwords:     tt.passwords,
+			maxDepth:      3,
+			maxMembers:    100,
+			maxMemberSize: 1024,
+			maxTotalSize:  4096,
+		}
+		if tt.maxDepth > 0 {
+			e.maxDepth = tt.maxDepth
+		}
+		if tt.maxMembers > 0 {
+			e.maxMembers = tt.maxMembers
+		}
+		if tt.maxMemberSize > 0 {
+			e.maxMemberSize = tt.maxMemberSize
+		}
+		if tt.maxTotalSize > 0 {
+			e.maxTotalSize = tt.maxTotalSize
+		}
+
+		err := e.expand(path, "", 0)
+		members := e.members
+		e.cleanup(0)
+
+		if tt.errorText != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.errorText) {
+				t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.errorText, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if len(members) != len(tt.members) {
+			t.Errorf("%s: expected %d members, got %d", tt.name, len(tt.members), len(members))
+			continue
+		}
+
+		for i, m := range members {
+			if m.Member != tt.members[i] {
+				t.Errorf("%s: expected member %s, got %s", tt.name, tt.members[i], m.Member)
+			}
+		}
+	}
+}
+
+func TestExtractedContent(t *testing.T) {
+	sample := []byte("the decrypted sample")
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := ioutil.WriteFile(path, buildZip(t, zipEntry{"mal.exe", sample, "infected"}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &extractor{passwords: []string{"infected"}, maxDepth: 3, maxMembers: 10, maxMemberSize: 1024, maxTotalSize: 1024}
+	defer e.cleanup(0)
+
+	if err := e.expand(path, "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e.members) != 1 {
+		t.Fatalf("expected 1 member, got %d", len(e.members))
+	}
+
+	data, err := ioutil.ReadFile(e.members[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, sample) {
+		t.Errorf("expected %q, got %q", sample, data)
+	}
+}
@@ -0,0 +1,67 @@
+package feed
+
+import (
+	"sync"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+
+	"github.com/streadway/amqp"
+)
+
+// work items waiting for free slots at their service, a cancel
+// request matching one of them is delivered on its channel
+type waitingSet struct {
+	mutex sync.Mutex
+	items map[*lib.FeedRequest]chan *lib.CancelRequest
+}
+
+// add puts the work item into the waiting set and returns the
+// channel a cancel request for it is sent on.
+func (w *waitingSet) add(feedReq *lib.FeedRequest) chan *lib.CancelRequest {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.items == nil {
+		w.items = make(map[*lib.FeedRequest]chan *lib.CancelRequest)
+	}
+
+	cancel := make(chan *lib.CancelRequest, 1)
+	w.items[feedReq] = cancel
+	return cancel
+}
+
+func (w *waitingSet) remove(feedReq *lib.FeedRequest) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	delete(w.items, feedReq)
+}
+
+// cancel hands cr to all waiting work items it references.
+func (w *waitingSet) cancel(cr *lib.CancelRequest) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for feedReq, cancel := range w.items {
+		if !cr.Matches(feedReq.OriginalRequest, feedReq.Service, feedReq.SampleHashes()...) {
+			continue
+		}
+
+		select {
+		case cancel <- cr:
+		default:
+		}
+	}
+}
+
+// cancelled checks if the work item was cancelled already and if so
+// ends it. path is the local sample, if there is one yet.
+func (c *fCtx) cancelled(feedReq *lib.FeedRequest, service *lib.Service, path string, msg *amqp.Delivery) bool {
+	cr := c.Cancelled(feedReq.OriginalRequest, feedReq.Service, feedReq.SampleHashes()...)
+	if cr == nil {
+		return false
+	}
+
+	c.CancelTask(c.taskOf(feedReq, service, path), cr, msg)
+	return true
+}
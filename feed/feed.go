@@ -1,10 +1,14 @@
 package feed
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"time"
 
@@ -18,20 +22,46 @@ type fCtx struct {
 	*lib.Ctx
 
 	Producer *lib.QueueHandler // the queue read by check
+	Splitter *lib.QueueHandler // the queue holding the per-service work items
+	Requests *lib.QueueHandler // the same queue in transactional mode, only used by parseMsg
+	Delayer  *lib.QueueHandler // the delay queue of the work items, used while a service is rate limited
+
+	waiting waitingSet
 }
 
 // Run starts the feed module either blocking or non-blocking.
 func Run(ctx *lib.Ctx, blocking bool) error {
-	producer, err := ctx.SetupQueue("totem-dynamic-check-" + ctx.Config.QueueSuffix)
+	producer, err := ctx.SetupConfirmedQueue("totem-dynamic-check-" + ctx.Config.QueueSuffix)
+	if err != nil {
+		return err
+	}
+
+	splitter, err := ctx.SetupConfirmedQueue("totem-dynamic-feed-" + ctx.Config.QueueSuffix)
+	if err != nil {
+		return err
+	}
+
+	requests, err := ctx.SetupTxQueue("totem-dynamic-feed-" + ctx.Config.QueueSuffix)
+	if err != nil {
+		return err
+	}
+
+	delayer, err := ctx.SetupDelayQueue("totem-dynamic-feed-" + ctx.Config.QueueSuffix)
 	if err != nil {
 		return err
 	}
 
 	c := &fCtx{
-		ctx,
-		producer,
+		Ctx:      ctx,
+		Producer: producer,
+		Splitter: splitter,
+		Requests: requests,
+		Delayer:  delayer,
 	}
 
+	c.HandleCancel(c.waiting.cancel)
+
+	go c.Consume("totem-dynamic-feed-"+ctx.Config.QueueSuffix, ctx.Config.FeedPrefetchCount, c.parseWorkItem)
 	if blocking {
 		c.Consume(ctx.Config.ConsumeQueue, ctx.Config.FeedPrefetchCount, c.parseMsg)
 	} else {
@@ -42,8 +72,12 @@ func Run(ctx *lib.Ctx, blocking bool) error {
 }
 
 // parseMsg accepts an *amqp.Delivery and parses the body assuming
-// it's a request from the gateway. On success the parsed struct is
-// send to handleFeeding.
+// it's a request from the gateway. The request is split into one
+// work item per requested service which are persisted in the feed
+// queue in one transaction, so a nacked request left no work items
+// behind. Only after the transaction was committed the original
+// message is acked, from there on every service task succeeds or
+// fails on its own.
 func (c *fCtx) parseMsg(msg amqp.Delivery) {
 	req := &lib.ExternalRequest{}
 	err := json.Unmarshal(msg.Body, req)
@@ -56,44 +90,211 @@ func (c *fCtx) parseMsg(msg amqp.Delivery) {
 	//	return
 	//}
 
-	for serviceName, _ := range req.Tasks {
-		urls, check := c.Config.Services[serviceName]
-		if !check {
-			//c.NackOnError(errors.New(serviceName+" not found"), "Service is not existing on this node", msg)
-			//return
-			c.Warning.Println("Service is not existing on this node")
-			continue
+	if req.Received.IsZero() {
+		req.Received = time.Now()
+	}
+
+	// the request ID correlates all results of the request
+	if req.RequestID == "" {
+		req.RequestID, err = newRequestID()
+		if c.NackOnError(err, "Could not create request ID", &msg) {
+			return
 		}
+	}
 
-		if len(urls) == 0 {
-			c.Warning.Println("Service is existing in config but no URLs are supplied")
+	// a relative deadline starts when the request arrives
+	if req.TTL > 0 {
+		deadline := time.Now().Add(time.Second * time.Duration(req.TTL))
+		if req.Deadline.IsZero() || deadline.Before(req.Deadline) {
+			req.Deadline = deadline
+		}
+	}
+
+	items := [][]byte{}
+	services := c.Services()
+	for serviceName, args := range req.Tasks {
+		if _, check := services[serviceName]; !check && serviceName != lib.AllApplicable {
+			c.Warning.Println("Service", serviceName, "is not existing on this node")
 			continue
 		}
 
-		service := &lib.Service{
-			Name:   serviceName,
-			URL:    urls[rand.Intn(len(urls))],
-			Client: c.Client,
+		options, err := lib.ParseTaskArguments(args)
+		if c.NackOnError(err, "Invalid arguments for "+serviceName, &msg) {
+			return
+		}
+
+		item, err := json.Marshal(lib.FeedRequest{
+			Service:         serviceName,
+			Options:         options,
+			OriginalRequest: req,
+		})
+		if c.NackOnError(err, "Could not create feedRequest!", &msg) {
+			return
+		}
+
+		items = append(items, item)
+	}
+
+	if len(items) == 0 {
+		c.NackOnError(errors.New("no known service requested"), "Nothing to do for this request", &msg)
+		return
+	}
+
+	for _, item := range items {
+		err = c.Requests.Send(item)
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = c.Requests.Commit()
+	}
+
+	if err != nil {
+		if rerr := c.Requests.Rollback(); rerr != nil {
+			c.Warning.Println("Rolling back the work items failed!", rerr.Error())
 		}
 
-		go c.handleFeeding(req, service, &msg)
+		c.NackOnError(err, "Could not persist feedRequest!", &msg)
+		return
+	}
+
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
 	}
 }
 
-// handleFeeding checks the status of the respective service
-// and uploads the new sample if everything is fine. If not
-// either an error is send or a waiting timer is actived.
-func (c *fCtx) handleFeeding(req *lib.ExternalRequest, service *lib.Service, msg *amqp.Delivery) {
+// parseWorkItem accepts an *amqp.Delivery and parses the body assuming
+// it's a work item created by parseMsg. On success a service URL is
+// chosen and the work item is handed to handleFeeding.
+func (c *fCtx) parseWorkItem(msg amqp.Delivery) {
+	req := &lib.FeedRequest{}
+	err := json.Unmarshal(msg.Body, req)
+	if c.NackOnError(err, "Could not decode json!", &msg) {
+		return
+	}
+
+	if req.Service == lib.AllApplicable {
+		go c.handleAllApplicable(req, &msg)
+		return
+	}
+
+	urls, check := c.Services()[req.Service]
+	if !check {
+		c.NackOnError(errors.New(req.Service+" not found"), "Service is not existing on this node", &msg)
+		return
+	}
+
+	urls = excludeURLs(urls, req.ExcludeURLs)
+
+	if len(urls) == 0 {
+		c.NackOnError(errors.New(req.Service+" has no URLs"), "Service is existing in config but no URLs are supplied", &msg)
+		return
+	}
+
+	service := c.NewService(req.Service, urls[rand.Intn(len(urls))])
+
+	go c.handleFeeding(req, service, &msg)
+}
+
+// handleFeeding prepares the sample of the work item, checks the
+// status of the respective service and uploads the new sample if
+// everything is fine. If not either an error is send or a waiting
+// timer is actived.
+func (c *fCtx) handleFeeding(feedReq *lib.FeedRequest, service *lib.Service, msg *amqp.Delivery) {
+	req := feedReq.OriginalRequest
+
+	// the sample belongs to the work item until it is handed to check,
+	// on every other way out it is removed
+	samplePath := feedReq.LocalPath
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			c.RemoveFile(samplePath)
+		}
+	}()
+
+	if req.Expired() {
+		c.expire(feedReq, service, feedReq.LocalPath, msg)
+		return
+	}
+
+	if c.cancelled(feedReq, service, feedReq.LocalPath, msg) {
+		return
+	}
+
+	// the work item isn't held while the service is rate limited
+	if delay := service.Delay(); delay > 0 {
+		handedOver = c.delay(msg.Body, feedReq.LocalPath, delay, msg)
+		return
+	}
+
+	sample, ok := c.prepareSample(feedReq, msg)
+	if !ok {
+		return
+	}
+	samplePath = sample.Path
+
+	// now the hash of the sample is known
+	if c.cancelled(feedReq, service, sample.Path, msg) {
+		return
+	}
+
 	// get the status of the service
 	status, err := service.Status()
 	if c.NackOnError(err, "Service is not existing on this node", msg) {
 		return
 	}
 
+	info, err := c.ServiceInfo(service.Name, service.URL)
+	if c.NackOnError(err, "Could not get a valid info of "+service.Name, msg) {
+		return
+	}
+
+	if info != nil && !info.Accepts(feedReq.ObjectType) {
+		c.rejectIncompatible(errors.New(service.Name+" does not accept "+feedReq.ObjectType+" objects"), sample.Path, msg)
+		return
+	}
+
+	if info != nil {
+		for option := range feedReq.Options {
+			if !info.SupportsOption(option) {
+				c.NackOnError(errors.New(service.Name+" does not support the option "+option), "Invalid arguments for "+service.Name, msg)
+				return
+			}
+		}
+	}
+
+	// check if the service can handle the sample at all
+	accepted, configured := c.Config.AcceptedTypes[service.Name]
+	if !configured {
+		accepted = status.AcceptedTypes
+	}
+
+	if len(accepted) > 0 && !acceptsType(accepted, feedReq.FileType) {
+		c.rejectIncompatible(errors.New(service.Name+" does not accept "+feedReq.FileType+" samples"), sample.Path, msg)
+		return
+	}
+
 	// check if the service has free capacity
+	cancel := c.waiting.add(feedReq)
+	defer c.waiting.remove(feedReq)
+
 	for status.FreeSlots <= 0 {
 		c.Debug.Println("Slowdown: No free slots")
-		time.Sleep(time.Second * 30)
+
+		select {
+		case cr := <-cancel:
+			c.CancelTask(c.taskOf(feedReq, service, sample.Path), cr, msg)
+			return
+		case <-time.After(time.Second * 30):
+		}
+
+		if req.Expired() {
+			c.expire(feedReq, service, sample.Path, msg)
+			return
+		}
 
 		status, err = service.Status()
 		if c.NackOnError(err, "Service is not existing on this node", msg) {
@@ -101,65 +302,462 @@ func (c *fCtx) handleFeeding(req *lib.ExternalRequest, service *lib.Service, msg
 		}
 	}
 
-	// differentiate between downloadable samples and URLs
-	sample := ""
 	if req.Download {
-		// we need to download the sample to /tmp
-		resp, err := c.Client.Get(req.PrimaryURI)
-		if c.NackOnError(err, "Downloading the file failed from "+req.PrimaryURI+" failed", msg) {
+		// agree on how the sample gets to the service
+		service.Delivery, err = lib.NegotiateDelivery(c.Config.Delivery[service.Name], status.Delivery, c.Mux != nil)
+		if c.NackOnError(err, "Could not agree on a delivery mode with "+service.Name, msg) {
 			return
 		}
-		defer lib.SafeResponseClose(resp)
 
-		// return if file does not exist
-		if resp.StatusCode != 200 {
-			c.NackOnError(errors.New(resp.Status), req.PrimaryURI+" returned non-200 status code", msg)
-			return
+		if service.Delivery == lib.DeliveryURL {
+			sample.URL, err = c.SampleURL(sample.Name)
+			if c.NackOnError(err, "Could not sign sample url", msg) {
+				return
+			}
 		}
+	}
 
-		fileBytes, err := ioutil.ReadAll(resp.Body)
-		if c.NackOnError(err, "couldn't read downloaded file!", msg) {
+	// let the service notify us instead of being polled
+	callbackToken := ""
+	if (status.Callbacks || (info != nil && info.Supports(lib.FeatureCallbacks))) && c.Mux != nil {
+		callbackToken, sample.Callback, err = c.CallbackURL()
+		if c.NackOnError(err, "Could not create callback url", msg) {
 			return
 		}
+	}
 
-		tmpFile, err := ioutil.TempFile("/tmp/", "totem-dynamic")
-		if c.NackOnError(err, "couldn't create file in /tmp", msg) {
-			return
-		}
+	// the work item might have been cancelled in the meantime
+	select {
+	case cr := <-cancel:
+		c.CancelTask(c.taskOf(feedReq, service, sample.Path), cr, msg)
+		return
+	default:
+	}
 
-		err = ioutil.WriteFile(tmpFile.Name(), fileBytes, 0644)
-		if c.NackOnError(err, "couldn't create file in /tmp", msg) {
+	// create new task
+	resp, err := service.NewTask(sample, feedReq.Options)
+	if err == lib.ErrRateLimited {
+		// the prepared sample is kept for the next attempt
+		item := *feedReq
+		item.LocalPath = sample.Path
+
+		itemJ, err := json.Marshal(item)
+		if c.NackOnError(err, "Could not create feedRequest!", msg) {
 			return
 		}
 
-		sample = filepath.Base(tmpFile.Name())
-	} else {
-		// we do not need to download the sample
-		// the filename "is the sample data"
-		sample = req.Filename
+		handedOver = c.delay(itemJ, sample.Path, service.Delay(), msg)
+		return
 	}
 
-	// create new task
-	resp, err := service.NewTask(sample)
 	if c.NackOnError(err, "Feeding sample to service failed", msg) {
 		return
 	}
 
-	internalReq, err := json.Marshal(lib.InternalRequest{
+	if len(feedReq.Options) > 0 && resp.Options == nil {
+		c.Warning.Println(service.Name, "did not echo the task options, they might have been ignored")
+	}
+
+	started := time.Now()
+	submitted := lib.TaskState{State: lib.StateSubmitted, Time: started}
+
+	task := &lib.InternalRequest{
 		Service:         service.Name,
 		URL:             service.URL,
 		TaskID:          resp.TaskID,
-		FilePath:        sample,
-		Started:         time.Now(),
-		OriginalRequest: req,
-	})
+		FilePath:        sample.Name,
+		Options:         resp.Options,
+		Parent:          feedReq.Parent,
+		FileType:        feedReq.FileType,
+		ObjectType:      feedReq.ObjectType,
+		Hashes:          feedReq.Hashes,
+		NormalizedURL:   feedReq.NormalizedURL,
+		URLHash:         feedReq.URLHash,
+		Refed:           feedReq.Refed,
+		CallbackToken:   callbackToken,
+		States:          []lib.TaskState{submitted},
+		Started:         started,
+		OriginalRequest: req.WithoutPasswords(),
+	}
+
+	internalReq, err := json.Marshal(task)
 	if c.NackOnError(err, "Could not create internalRequest!", msg) {
 		return
 	}
 
+	err = c.HandOverFile(sample.Path)
+	if c.NackOnError(err, "Could not claim the sample for check!", msg) {
+		return
+	}
+
 	// send to check
-	c.Producer.Send(internalReq)
+	err = c.Producer.Send(internalReq)
+	if c.NackOnError(err, "Could not send internalRequest to check!", msg) {
+		return
+	}
+	handedOver = true
+
+	c.PublishEvent(task, "", &submitted)
+
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
+	}
+}
+
+// handleAllApplicable creates a work item for every service that
+// accepts the file type of the sample and was not requested
+// explicitly. Only services which declare their accepted types, in
+// the config or in their status, are considered.
+func (c *fCtx) handleAllApplicable(feedReq *lib.FeedRequest, msg *amqp.Delivery) {
+	if feedReq.OriginalRequest.Expired() {
+		c.expire(feedReq, nil, feedReq.LocalPath, msg)
+		return
+	}
+
+	sample, ok := c.prepareSample(feedReq, msg)
+	if !ok {
+		return
+	}
+
+	names := []string{}
+	for name := range c.Services() {
+		if _, explicit := feedReq.OriginalRequest.Tasks[name]; explicit {
+			continue
+		}
+
+		if acceptsType(c.declaredTypes(name, feedReq.ObjectType), feedReq.FileType) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		c.rejectIncompatible(errors.New("no service accepts "+feedReq.FileType+" samples"), sample.Path, msg)
+		return
+	}
+
+	for _, name := range names {
+		item := *feedReq
+		item.Service = name
+
+		// every service task owns its own copy of the sample
+		var err error
+		if sample.Path != "" {
+			item.LocalPath, err = copyToTmp(sample.Path)
+		}
+
+		var itemJ []byte
+		if err == nil {
+			itemJ, err = json.Marshal(item)
+		}
+
+		if err == nil {
+			err = c.HandOverFile(item.LocalPath)
+		}
+
+		if err == nil {
+			err = c.Splitter.Send(itemJ)
+		}
+
+		if c.NackOnError(err, "Could not create work item for "+name, msg) {
+			// the work items sent so far are on their way already
+			c.RemoveFile(item.LocalPath)
+			c.RemoveFile(sample.Path)
+			return
+		}
+
+		c.Debug.Println("Added", name, "for", feedReq.FileType, "sample")
+	}
+
+	c.RemoveFile(sample.Path)
+
 	if err := msg.Ack(false); err != nil {
 		c.Warning.Println("Sending ACK failed!", err.Error())
 	}
 }
+
+// delay puts the work item back into the feed queue once delay
+// passed and acks msg, the sample at path stays claimed for it. It
+// reports whether the work item was handed over.
+func (c *fCtx) delay(item []byte, path string, delay time.Duration, msg *amqp.Delivery) bool {
+	err := c.HandOverFile(path)
+	if err == nil {
+		err = c.Delayer.SendDelayed(item, delay)
+	}
+
+	if c.NackOnError(err, "Could not delay the work item", msg) {
+		return false
+	}
+
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
+	}
+
+	return true
+}
+
+// expire ends a work item whose deadline passed before it was fed,
+// path is the sample in /tmp if it was fetched already.
+func (c *fCtx) expire(feedReq *lib.FeedRequest, service *lib.Service, path string, msg *amqp.Delivery) {
+	c.ExpireTask(c.taskOf(feedReq, service, path), msg)
+}
+
+// taskOf returns the task for a work item which did not reach the
+// service yet.
+func (c *fCtx) taskOf(feedReq *lib.FeedRequest, service *lib.Service, path string) *lib.InternalRequest {
+	req := &lib.InternalRequest{
+		Service:         feedReq.Service,
+		Parent:          feedReq.Parent,
+		ObjectType:      feedReq.ObjectType,
+		Hashes:          feedReq.Hashes,
+		NormalizedURL:   feedReq.NormalizedURL,
+		URLHash:         feedReq.URLHash,
+		OriginalRequest: feedReq.OriginalRequest.WithoutPasswords(),
+	}
+
+	if service != nil {
+		req.URL = service.URL
+	}
+
+	if path != "" {
+		req.FilePath = filepath.Base(path)
+	}
+
+	return req
+}
+
+// declaredTypes returns the file types a service accepts for objects
+// of objectType, taken from the config or else from the cached info
+// of the service. A service which lists the object type in its info
+// without declaring file types accepts all of them. Only for services
+// without info the status is asked.
+func (c *fCtx) declaredTypes(name, objectType string) []string {
+	if accepted, ok := c.Config.AcceptedTypes[name]; ok {
+		return accepted
+	}
+
+	urls := c.Services()[name]
+	if len(urls) == 0 {
+		return nil
+	}
+
+	service := c.NewService(name, urls[rand.Intn(len(urls))])
+
+	info, err := c.ServiceInfo(service.Name, service.URL)
+	if err == nil && info != nil {
+		switch {
+		case !info.Accepts(objectType):
+			return nil
+		case info.AcceptedTypes != nil:
+			return info.AcceptedTypes
+		case len(info.ObjectTypes) > 0:
+			return []string{"*"}
+		default:
+			return nil
+		}
+	}
+
+	status, err := service.Status()
+	if err != nil {
+		c.Warning.Println("Could not get the status of", name, err.Error())
+		return nil
+	}
+
+	return status.AcceptedTypes
+}
+
+// prepareSample makes the sample of the work item available in /tmp,
+// expands archives if enabled and detects the file type. If false is
+// returned the work item was handled completely and msg was acked or
+// nacked already.
+func (c *fCtx) prepareSample(feedReq *lib.FeedRequest, msg *amqp.Delivery) (*lib.Sample, bool) {
+	req := feedReq.OriginalRequest
+
+	// differentiate between downloadable samples and URLs
+	sample := &lib.Sample{}
+	if !req.Download {
+		// we do not need to download the sample
+		// the filename "is the sample data"
+		sample.Name = req.Filename
+		feedReq.FileType = typeURL
+		feedReq.ObjectType, feedReq.NormalizedURL = normalizeObject(req.Filename)
+		feedReq.URLHash = hashString(feedReq.NormalizedURL)
+		return sample, true
+	}
+
+	feedReq.ObjectType = lib.ObjectFile
+
+	sample.Path = feedReq.LocalPath
+	if sample.Path == "" {
+		// we need to download the sample to /tmp
+		tmpPath, hashes, err := c.downloadSample(req)
+		if c.NackOnError(err, "Downloading the sample failed", msg) {
+			return nil, false
+		}
+
+		sample.Path = tmpPath
+		feedReq.Hashes = hashes
+	}
+	sample.Name = filepath.Base(sample.Path)
+
+	// members of an archive are expanded already
+	if c.Config.ExpandArchives && feedReq.Parent == nil {
+		expanded, err := c.expandArchive(feedReq, sample.Path)
+		if c.NackOnError(err, "Expanding the archive failed", msg) {
+			c.RemoveFile(sample.Path)
+			return nil, false
+		}
+
+		if expanded {
+			if err := msg.Ack(false); err != nil {
+				c.Warning.Println("Sending ACK failed!", err.Error())
+			}
+			return nil, false
+		}
+	}
+
+	// local samples were not hashed while downloading
+	if feedReq.Hashes == nil {
+		hashes, err := hashFile(sample.Path)
+		if c.NackOnError(err, "Could not hash the sample", msg) {
+			c.RemoveFile(sample.Path)
+			return nil, false
+		}
+
+		feedReq.Hashes = hashes
+	}
+
+	if feedReq.FileType == "" {
+		fileType, err := detectFileType(sample.Path)
+		if c.NackOnError(err, "Could not detect the file type", msg) {
+			c.RemoveFile(sample.Path)
+			return nil, false
+		}
+
+		feedReq.FileType = fileType
+	}
+
+	return sample, true
+}
+
+// rejectIncompatible handles work items whose sample can't be
+// analysed by the service. Depending on IncompatibleTypes they
+// are dropped or sent to the failed queue.
+func (c *fCtx) rejectIncompatible(reason error, path string, msg *amqp.Delivery) {
+	c.RemoveFile(path)
+
+	if c.Config.IncompatibleTypes == "fail" {
+		c.NackOnError(reason, "Incompatible file type", msg)
+		return
+	}
+
+	c.Info.Println("Skipping task:", reason.Error())
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
+	}
+}
+
+// newRequestID returns a random ID for requests without one.
+func newRequestID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := crand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// excludeURLs returns the urls which are not in exclude.
+func excludeURLs(urls, exclude []string) []string {
+	if len(exclude) == 0 {
+		return urls
+	}
+
+	left := []string{}
+	for _, u := range urls {
+		excluded := false
+		for _, e := range exclude {
+			if u == e {
+				excluded = true
+				break
+			}
+		}
+
+		if !excluded {
+			left = append(left, u)
+		}
+	}
+
+	return left
+}
+
+// copyToTmp copies the file at path into a new file in /tmp.
+func copyToTmp(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmpFile, err := ioutil.TempFile("/tmp/", "totem-dynamic")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	_, err = io.Copy(tmpFile, src)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+
+	return tmpFile.Name(), nil
+}
+
+// downloadSample fetches the sample of the request into a new file
+// in /tmp and returns its path together with its hashes, which are
+// computed while downloading. If the PrimaryURI fails the
+// SecondaryURI is tried.
+func (c *fCtx) downloadSample(req *lib.ExternalRequest) (string, *lib.Hashes, error) {
+	var sample io.ReadCloser
+	var err error
+
+	for _, uri := range []string{req.PrimaryURI, req.SecondaryURI} {
+		if uri == "" {
+			continue
+		}
+
+		sample, err = c.FetchSample(uri)
+		if err == nil {
+			break
+		}
+
+		c.Warning.Println("Fetching the sample from", uri, "failed:", err.Error())
+	}
+
+	if sample == nil {
+		if err == nil {
+			err = errors.New("no sample URI given")
+		}
+
+		return "", nil, err
+	}
+	defer sample.Close()
+
+	tmpFile, err := ioutil.TempFile("/tmp/", "totem-dynamic")
+	if err != nil {
+		return "", nil, err
+	}
+	defer tmpFile.Close()
+
+	// hash the sample while it is written
+	h := newHasher()
+	_, err = io.Copy(io.MultiWriter(tmpFile, h), sample)
+	hashes := h.sum()
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", nil, err
+	}
+
+	c.UseFile(tmpFile.Name())
+	return tmpFile.Name(), hashes, nil
+}
@@ -0,0 +1,137 @@
+package feed
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// file type of samples which are not downloaded, like URLs
+const typeURL = "url"
+
+// detectFileType determines the type of the file at path by its
+// magic bytes. The returned names are the ones used in the
+// AcceptedTypes of the services, "unknown" is returned for
+// everything that is not recognised.
+func detectFileType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 1024)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("MZ")):
+		return peType(f), nil
+	case bytes.HasPrefix(header, []byte("\x7fELF")):
+		return "elf", nil
+	case bytes.HasPrefix(header, []byte("\xfe\xed\xfa\xce")),
+		bytes.HasPrefix(header, []byte("\xfe\xed\xfa\xcf")),
+		bytes.HasPrefix(header, []byte("\xce\xfa\xed\xfe")),
+		bytes.HasPrefix(header, []byte("\xcf\xfa\xed\xfe")):
+		return "macho", nil
+	case bytes.HasPrefix(header, []byte("%PDF")):
+		return "pdf", nil
+	case bytes.HasPrefix(header, []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")):
+		return "msoffice", nil
+	case bytes.HasPrefix(header, []byte("{\\rtf")):
+		return "rtf", nil
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return zipType(path), nil
+	case bytes.HasPrefix(header, []byte("7z\xbc\xaf\x27\x1c")):
+		return "7z", nil
+	case bytes.HasPrefix(header, []byte("Rar!\x1a\x07")):
+		return "rar", nil
+	case bytes.HasPrefix(header, []byte("\x1f\x8b")):
+		return "gzip", nil
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		return "tar", nil
+	case bytes.HasPrefix(header, []byte("dex\n")):
+		return "dex", nil
+	case bytes.HasPrefix(header, []byte("#!")):
+		return "script", nil
+	}
+
+	text := bytes.ToLower(bytes.TrimSpace(header))
+	if bytes.HasPrefix(text, []byte("<!doctype html")) || bytes.HasPrefix(text, []byte("<html")) {
+		return "html", nil
+	}
+
+	return "unknown", nil
+}
+
+// peType distinguishes 32 and 64 bit executables and dlls by
+// their PE header. Files without one are plain DOS executables.
+func peType(f *os.File) string {
+	offset := make([]byte, 4)
+	if _, err := f.ReadAt(offset, 0x3c); err != nil {
+		return "msdos"
+	}
+
+	header := make([]byte, 26)
+	if _, err := f.ReadAt(header, int64(binary.LittleEndian.Uint32(offset))); err != nil ||
+		!bytes.HasPrefix(header, []byte("PE\x00\x00")) {
+		return "msdos"
+	}
+
+	characteristics := binary.LittleEndian.Uint16(header[22:24])
+	if characteristics&0x2000 != 0 {
+		return "dll"
+	}
+
+	if binary.LittleEndian.Uint16(header[24:26]) == 0x20b {
+		return "pe64"
+	}
+
+	return "pe32"
+}
+
+// zipType separates plain zip archives from formats which happen
+// to use zip as container, like office documents, jars or apks.
+func zipType(path string) string {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return "unknown"
+	}
+	defer r.Close()
+
+	names := make(map[string]bool)
+	for _, f := range r.File {
+		names[f.Name] = true
+	}
+
+	// apks are jars as well, so the order matters
+	switch {
+	case names["[Content_Types].xml"]:
+		return "ooxml"
+	case names["AndroidManifest.xml"]:
+		return "apk"
+	case names["META-INF/MANIFEST.MF"]:
+		return "jar"
+	case names["mimetype"]:
+		return "odf"
+	}
+
+	return "zip"
+}
+
+// acceptsType checks if the file type is in the list of accepted
+// types, "*" accepts everything.
+func acceptsType(accepted []string, fileType string) bool {
+	for _, t := range accepted {
+		if t == "*" || t == fileType {
+			return true
+		}
+	}
+
+	return false
+}
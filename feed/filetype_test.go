@@ -0,0 +1,112 @@
+package feed
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// peFile builds a minimal executable with a PE header carrying the
+// given characteristics and optional header magic.
+func peFile(characteristics, magic uint16) []byte {
+	data := make([]byte, 0x80+26)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], 0x80)
+	copy(data[0x80:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(data[0x80+22:], characteristics)
+	binary.LittleEndian.PutUint16(data[0x80+24:], magic)
+	return data
+}
+
+func zipWith(t *testing.T, names ...string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, name := range names {
+		if _, err := w.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDetectFileType(t *testing.T) {
+	tarHeader := make([]byte, 512)
+	copy(tarHeader[257:], "ustar")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		fileType string
+	}{
+		{"pe32", peFile(0x0102, 0x10b), "pe32"},
+		{"pe64", peFile(0x0022, 0x20b), "pe64"},
+		{"dll", peFile(0x2102, 0x10b), "dll"},
+		{"dos", []byte("MZ just a dos stub"), "msdos"},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), "elf"},
+		{"macho", []byte("\xcf\xfa\xed\xfe\x07\x00\x00\x01"), "macho"},
+		{"pdf", []byte("%PDF-1.7\n"), "pdf"},
+		{"office", []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1\x00"), "msoffice"},
+		{"rtf", []byte("{\\rtf1\\ansi"), "rtf"},
+		{"zip", zipWith(t, "a.txt"), "zip"},
+		{"ooxml", zipWith(t, "[Content_Types].xml", "word/document.xml"), "ooxml"},
+		{"apk", zipWith(t, "AndroidManifest.xml", "META-INF/MANIFEST.MF", "classes.dex"), "apk"},
+		{"jar", zipWith(t, "META-INF/MANIFEST.MF", "Main.class"), "jar"},
+		{"odf", zipWith(t, "mimetype", "content.xml"), "odf"},
+		{"broken zip", []byte("PK\x03\x04 truncated"), "unknown"},
+		{"7z", []byte("7z\xbc\xaf\x27\x1c\x00\x04"), "7z"},
+		{"rar", []byte("Rar!\x1a\x07\x00"), "rar"},
+		{"gzip", []byte("\x1f\x8b\x08\x00"), "gzip"},
+		{"tar", tarHeader, "tar"},
+		{"dex", []byte("dex\n035\x00"), "dex"},
+		{"script", []byte("#!/bin/sh\necho hi\n"), "script"},
+		{"html", []byte("  <!DOCTYPE html><html></html>"), "html"},
+		{"html without doctype", []byte("<HTML><body></body></HTML>"), "html"},
+		{"text", []byte("just some text"), "unknown"},
+		{"empty", []byte{}, "unknown"},
+	}
+
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(path, tt.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		fileType, err := detectFileType(path)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if fileType != tt.fileType {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.fileType, fileType)
+		}
+	}
+}
+
+func TestAcceptsType(t *testing.T) {
+	tests := []struct {
+		accepted []string
+		fileType string
+		accepts  bool
+	}{
+		{nil, "pe32", false},
+		{[]string{"*"}, "pe32", true},
+		{[]string{"pe32", "dll"}, "dll", true},
+		{[]string{"pe32", "dll"}, "pdf", false},
+	}
+
+	for _, tt := range tests {
+		if acceptsType(tt.accepted, tt.fileType) != tt.accepts {
+			t.Errorf("acceptsType(%v, %s) should be %t", tt.accepted, tt.fileType, tt.accepts)
+		}
+	}
+}
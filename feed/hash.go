@@ -0,0 +1,166 @@
+package feed
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+
+	"github.com/glaslos/ssdeep"
+	"github.com/glaslos/tlsh"
+)
+
+// tlshMinSize is the smallest sample the reference TLSH implementation
+// hashes, the tlsh package hashes any sample.
+const tlshMinSize = 50
+
+// hasher computes all hashes of a sample while it is written, so
+// the sample only has to be read once.
+type hasher struct {
+	md5    hash.Hash
+	sha1   hash.Hash
+	sha256 hash.Hash
+	sha512 hash.Hash
+	ssdeep hash.Hash
+	size   int64
+
+	// tlsh only hashes readers, it is fed through a pipe
+	tlshPipe *io.PipeWriter
+	tlshDone chan string
+}
+
+func newHasher() *hasher {
+	h := &hasher{
+		md5:      md5.New(),
+		sha1:     sha1.New(),
+		sha256:   sha256.New(),
+		sha512:   sha512.New(),
+		ssdeep:   ssdeep.New(),
+		tlshDone: make(chan string, 1),
+	}
+
+	r, w := io.Pipe()
+	h.tlshPipe = w
+
+	go func() {
+		t, err := tlsh.HashReader(bufio.NewReader(r))
+
+		// drain the pipe in case tlsh stopped early
+		io.Copy(ioutil.Discard, r)
+
+		if err != nil {
+			// too uniform samples have no TLSH
+			h.tlshDone <- ""
+			return
+		}
+
+		h.tlshDone <- t.String()
+	}()
+
+	return h
+}
+
+func (h *hasher) Write(p []byte) (int, error) {
+	h.size += int64(len(p))
+	for _, w := range []io.Writer{h.md5, h.sha1, h.sha256, h.sha512, h.ssdeep, h.tlshPipe} {
+		w.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// sum finishes hashing and returns all hashes, the hasher can't be
+// used afterwards.
+func (h *hasher) sum() *lib.Hashes {
+	h.tlshPipe.Close()
+
+	t := <-h.tlshDone
+	if h.size < tlshMinSize {
+		t = ""
+	}
+
+	return &lib.Hashes{
+		MD5:    hex.EncodeToString(h.md5.Sum(nil)),
+		SHA1:   hex.EncodeToString(h.sha1.Sum(nil)),
+		SHA256: hex.EncodeToString(h.sha256.Sum(nil)),
+		SHA512: hex.EncodeToString(h.sha512.Sum(nil)),
+		SSDeep: string(h.ssdeep.Sum(nil)), // empty if the sample is too small
+		TLSH:   t,
+	}
+}
+
+// hashFile computes all hashes of a local sample, like an archive
+// member, which was not downloaded by feed.
+func hashFile(path string) (*lib.Hashes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := newHasher()
+	if _, err := io.Copy(h, f); err != nil {
+		h.sum()
+		return nil, err
+	}
+
+	return h.sum(), nil
+}
+
+// normalizeObject determines if a non-file sample is a URL or a
+// domain and normalises it, so equal objects get equal hashes:
+// scheme and host are lower-cased, default ports and fragments are
+// dropped and an empty path becomes "/". Objects with a path but
+// without a scheme are http URLs, only the others are domains.
+func normalizeObject(obj string) (string, string) {
+	obj = strings.TrimSpace(obj)
+
+	if !strings.Contains(obj, "://") && strings.ContainsAny(obj, "/?#") {
+		obj = "http://" + obj
+	}
+
+	u, err := url.Parse(obj)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return lib.ObjectDomain, strings.TrimSuffix(strings.ToLower(obj), ".")
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+
+	u.Fragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return lib.ObjectURL, u.String()
+}
+
+// hashString returns the hex encoded SHA256 of s.
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
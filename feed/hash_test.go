@@ -0,0 +1,124 @@
+package feed
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+
+	"github.com/glaslos/tlsh"
+)
+
+func TestHasher(t *testing.T) {
+	// the vectors of the ssdeep and tlsh test suites
+	random := make([]byte, 4097)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	license := []byte(strings.Repeat("MIT License is so cool license that I can't imagine a better one!!\n", 4))
+
+	randomTLSH, err := tlsh.HashBytes(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		hashes *lib.Hashes
+	}{
+		{"too small for fuzzy hashes", []byte("abc"), &lib.Hashes{
+			SHA512: "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f",
+		}},
+		{"tlsh", license, &lib.Hashes{
+			SHA512: "27c85e779fbefdcf32a0f2b6a2265b44440f4a1f17c06f99bc7cae5945210c0018be4756124f6943b071f07a3dedf01615a7f48be2cc96806592787fc819ec8e",
+			TLSH:   "8ed02202fc30802303a002b03b33300fc30a82f83008c2fa000a0080b8ba0e02cca0c3",
+		}},
+		{"ssdeep", random, &lib.Hashes{
+			SHA512: "052583f79ae428be478d22469edaa7098d93aca5500ee73923674e4be6784da826c277af8d1976bd0caffebd9e95ae0505ceebb45953d37751dbf999816ef493",
+			SSDeep: "96:yNDH/iNQaSXRLmOSxu1aQP4iWgC8JbkiA5Ix:yNLaNQhSxEgVYkiA5Ix",
+			TLSH:   randomTLSH.String(),
+		}},
+	}
+
+	for _, tt := range tests {
+		// the pipe to tlsh must not depend on how the sample is written
+		h := newHasher()
+		for chunks := bytes.NewBuffer(tt.data); chunks.Len() > 0; {
+			h.Write(chunks.Next(1000))
+		}
+
+		hashes := h.sum()
+		if hashes.SHA512 != tt.hashes.SHA512 {
+			t.Errorf("%s: expected SHA-512 %s, got %s", tt.name, tt.hashes.SHA512, hashes.SHA512)
+		}
+		if hashes.SSDeep != tt.hashes.SSDeep {
+			t.Errorf("%s: expected ssdeep %q, got %q", tt.name, tt.hashes.SSDeep, hashes.SSDeep)
+		}
+		if hashes.TLSH != tt.hashes.TLSH {
+			t.Errorf("%s: expected TLSH %q, got %q", tt.name, tt.hashes.TLSH, hashes.TLSH)
+		}
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample")
+	if err := ioutil.WriteFile(path, []byte("abc"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hashes.MD5 != "900150983cd24fb0d6963f7d28e17f72" || hashes.SHA1 != "a9993e364706816aba3e25717850c26c9cd0d89d" ||
+		hashes.SHA256 != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("unexpected hashes of abc: %+v", hashes)
+	}
+
+	if _, err := hashFile(path + ".missing"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestNormalizeObject(t *testing.T) {
+	tests := []struct {
+		obj        string
+		objectType string
+		normalized string
+	}{
+		{"http://Example.COM", lib.ObjectURL, "http://example.com/"},
+		{"HTTPS://example.com:443/a?b=c#frag", lib.ObjectURL, "https://example.com/a?b=c"},
+		{"http://example.com:80/", lib.ObjectURL, "http://example.com/"},
+		{"http://example.com:8080/Path", lib.ObjectURL, "http://example.com:8080/Path"},
+		{"https://example.com:80/", lib.ObjectURL, "https://example.com:80/"},
+		{"http://example.com./", lib.ObjectURL, "http://example.com/"},
+		{"http://[2001:DB8::1]/", lib.ObjectURL, "http://[2001:db8::1]/"},
+		{"http://[2001:db8::1]:8080", lib.ObjectURL, "http://[2001:db8::1]:8080/"},
+		{"  http://example.com/x  ", lib.ObjectURL, "http://example.com/x"},
+		{"example.com/path", lib.ObjectURL, "http://example.com/path"},
+		{"Example.COM:8080/a?b=c", lib.ObjectURL, "http://example.com:8080/a?b=c"},
+		{"example.com?q", lib.ObjectURL, "http://example.com/?q"},
+		{"Example.COM", lib.ObjectDomain, "example.com"},
+		{"example.com.", lib.ObjectDomain, "example.com"},
+		{" sub.example.com ", lib.ObjectDomain, "sub.example.com"},
+	}
+
+	for _, tt := range tests {
+		objectType, normalized := normalizeObject(tt.obj)
+		if objectType != tt.objectType || normalized != tt.normalized {
+			t.Errorf("normalizeObject(%q) = %s, %s; expected %s, %s", tt.obj, objectType, normalized, tt.objectType, tt.normalized)
+		}
+	}
+
+	// equal objects get equal hashes
+	_, a := normalizeObject("HTTP://EXAMPLE.com:80")
+	_, b := normalizeObject("http://example.com/#top")
+	if hashString(a) != hashString(b) {
+		t.Errorf("%s and %s should hash equally", a, b)
+	}
+}
@@ -0,0 +1,13 @@
+module github.com/HolmesProcessing/Holmes-Totem-Dynamic
+
+go 1.22
+
+require (
+	github.com/boltdb/bolt v1.3.1
+	github.com/glaslos/ssdeep v0.4.0
+	github.com/glaslos/tlsh v0.2.0
+	github.com/klauspost/compress v1.18.0
+	github.com/streadway/amqp v1.1.0
+)
+
+require golang.org/x/sys v0.9.0 // indirect
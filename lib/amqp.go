@@ -2,6 +2,11 @@ package lib
 
 import (
 	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -10,6 +15,9 @@ type QueueHandler struct {
 	Queue   string
 	Channel *amqp.Channel
 	C       *Ctx
+
+	confirms     chan amqp.Confirmation // only set in confirm mode
+	confirmMutex sync.Mutex
 }
 
 type FailedMsg struct {
@@ -46,7 +54,128 @@ func (c *Ctx) SetupQueue(queue string) (*QueueHandler, error) {
 		return nil, err
 	}
 
-	return &QueueHandler{queue, channel, c}, nil
+	return &QueueHandler{Queue: queue, Channel: channel, C: c}, nil
+}
+
+// SetupFanoutQueue declares the fanout exchange and queue and binds
+// them, so queue receives a copy of every message published on the
+// exchange. Every node binds its own queue to receive all messages.
+func (c *Ctx) SetupFanoutQueue(exchange, queue string) error {
+	handle, err := c.SetupQueue(queue)
+	if err != nil {
+		return err
+	}
+	defer handle.Channel.Close()
+
+	err = handle.Channel.ExchangeDeclare(
+		exchange, // name
+		"fanout", // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	return handle.Channel.QueueBind(
+		queue,    // queue
+		"",       // routing key
+		exchange, // exchange
+		false,    // no-wait
+		nil,      // arguments
+	)
+}
+
+// SetupConfirmedQueue works like SetupQueue but puts the channel
+// into confirm mode. Send on the returned QueueHandler only returns
+// after the broker confirmed that it took over the message.
+func (c *Ctx) SetupConfirmedQueue(queue string) (*QueueHandler, error) {
+	handle, err := c.SetupQueue(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := handle.confirmMode(); err != nil {
+		return nil, err
+	}
+
+	return handle, nil
+}
+
+// SetupDelayQueue declares a persistent queue which holds messages
+// until their delay passed and then moves them to queue. The returned
+// QueueHandler sends to the delay queue and is in confirm mode.
+func (c *Ctx) SetupDelayQueue(queue string) (*QueueHandler, error) {
+	c.Debug.Println("Creating new delay queue handler for", queue)
+
+	channel, err := c.AmqpConn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = channel.QueueDeclare(
+		queue+"-delayed", // name
+		true,             // durable
+		false,            // delete when unused
+		false,            // exclusive
+		false,            // no-wait
+		amqp.Table{ // expired messages are dead-lettered to queue
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := &QueueHandler{Queue: queue + "-delayed", Channel: channel, C: c}
+	if err := handle.confirmMode(); err != nil {
+		return nil, err
+	}
+
+	return handle, nil
+}
+
+// confirmMode puts the channel of the QueueHandler into confirm mode.
+func (q *QueueHandler) confirmMode() error {
+	if err := q.Channel.Confirm(false); err != nil {
+		return err
+	}
+
+	q.confirms = q.Channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return nil
+}
+
+// SetupTxQueue works like SetupQueue but puts the channel into
+// transactional mode. Messages sent on the returned QueueHandler are
+// only delivered once they are committed with Commit.
+func (c *Ctx) SetupTxQueue(queue string) (*QueueHandler, error) {
+	handle, err := c.SetupQueue(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	err = handle.Channel.Tx()
+	if err != nil {
+		return nil, err
+	}
+
+	return handle, nil
+}
+
+// Commit delivers the messages sent since the last commit or
+// rollback on a QueueHandler set up by SetupTxQueue.
+func (q *QueueHandler) Commit() error {
+	return q.Channel.TxCommit()
+}
+
+// Rollback drops the messages sent since the last commit or
+// rollback on a QueueHandler set up by SetupTxQueue.
+func (q *QueueHandler) Rollback() error {
+	return q.Channel.TxRollback()
 }
 
 // Consume connects to a queue as a consumer, sets the QoS
@@ -100,31 +229,102 @@ func (c *Ctx) Consume(queue string, prefetchCount int, fn func(msg amqp.Delivery
 // queue. Channel and queue name are taken from
 // the QueueHandler struct.
 func (q *QueueHandler) Send(msg []byte) error {
+	err := q.Publish("", q.Queue, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  "text/plain",
+		Body:         msg,
+	})
+	if err != nil {
+		return err
+	}
+
+	q.C.Info.Println("Dispatched", len(msg), "bytes to", q.Queue)
+
+	i := redactPasswords(msg)
+	if len(i) > 700 {
+		i = i[:700] + " [...]"
+	}
+	q.C.Debug.Println("Dispatched", i)
+
+	return nil
+}
+
+// longest delay of SendDelayed. Messages only leave a delay queue in
+// the order they were sent, so a short delay waits behind the longer
+// ones before it. Longer delays are split into several rounds.
+const maxDelay = 5 * time.Minute
+
+// SendDelayed sends msg to the delay queue of a QueueHandler set up by
+// SetupDelayQueue. It reaches the queue behind once delay passed, but
+// not later than maxDelay, so the receiver has to delay it again if
+// it is still too early.
+func (q *QueueHandler) SendDelayed(msg []byte, delay time.Duration) error {
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if delay < time.Second {
+		delay = time.Second
+	}
+
+	err := q.Publish("", q.Queue, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  "text/plain",
+		Body:         msg,
+		Expiration:   strconv.FormatInt(int64(delay/time.Millisecond), 10),
+	})
+	if err != nil {
+		return err
+	}
+
+	q.C.Info.Println("Delayed", len(msg), "bytes by", delay, "in", q.Queue)
+	return nil
+}
+
+// Publish publishes msg on the channel of the QueueHandler to any
+// exchange. In confirm mode it waits for the broker to confirm it.
+func (q *QueueHandler) Publish(exchange, key string, msg amqp.Publishing) error {
+	if q.confirms != nil {
+		// confirmations arrive in publishing order, so only one
+		// message may be in flight at a time
+		q.confirmMutex.Lock()
+		defer q.confirmMutex.Unlock()
+	}
+
 	err := q.Channel.Publish(
-		"",      // exchange
-		q.Queue, // routing key
-		false,   // mandatory
-		false,   // immediate
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "text/plain",
-			Body:         msg,
-		})
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		msg,
+	)
 	if err != nil {
 		return err
 	}
 
-	i := ""
-	if len(msg) > 700 {
-		i = string(msg[:700]) + " [...]"
-	} else {
-		i = string(msg)
+	if q.confirms != nil {
+		confirm, ok := <-q.confirms
+		if !ok {
+			return errors.New("Channel closed before the message was confirmed")
+		}
+
+		if !confirm.Ack {
+			return errors.New("Broker refused to take over the message")
+		}
 	}
 
-	q.C.Info.Println("Dispatched", i)
 	return nil
 }
 
+// archive passwords of a request, also when it is quoted inside of
+// a failed message
+var passwordsRegex = regexp.MustCompile(`(\\*"passwords\\*"\s*:\s*)\[[^\]]*\]`)
+
+// redactPasswords hides the archive passwords in msg for logging.
+func redactPasswords(msg []byte) string {
+	return passwordsRegex.ReplaceAllString(string(msg), "${1}[redacted]")
+}
+
 // NackOnError accepts an error, error description, and amqp
 // message. If the error is not nil a NACK is sent in reply
 // to the msg. The msg will be redirected to the failed queue
@@ -133,17 +333,7 @@ func (c *Ctx) NackOnError(err error, desc string, msg *amqp.Delivery) bool {
 	if err != nil {
 		c.Warning.Println("[NACK]", desc, err.Error())
 
-		jm, err := json.Marshal(FailedMsg{
-			msg.RoutingKey,
-			err.Error(),
-			desc,
-			string(msg.Body),
-		})
-		if err != nil {
-			c.Warning.Println(err.Error())
-		}
-
-		c.Failed.Send(jm)
+		c.sendFailed(msg.RoutingKey, err, desc, msg.Body)
 
 		err = msg.Nack(false, false)
 		if err != nil {
@@ -155,3 +345,32 @@ func (c *Ctx) NackOnError(err error, desc string, msg *amqp.Delivery) bool {
 
 	return false
 }
+
+// FailOnError works like NackOnError for tasks which are not
+// backed by an amqp message anymore, like the tasks kept in
+// the Store. The body is redirected to the failed queue.
+func (c *Ctx) FailOnError(err error, desc, queue string, body []byte) bool {
+	if err != nil {
+		c.Warning.Println("[FAILED]", desc, err.Error())
+
+		c.sendFailed(queue, err, desc, body)
+
+		return true
+	}
+
+	return false
+}
+
+func (c *Ctx) sendFailed(queue string, err error, desc string, body []byte) {
+	jm, err := json.Marshal(FailedMsg{
+		queue,
+		err.Error(),
+		desc,
+		string(body),
+	})
+	if err != nil {
+		c.Warning.Println(err.Error())
+	}
+
+	c.Failed.Send(jm)
+}
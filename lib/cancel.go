@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// bucket of the store holding the received cancel requests
+const cancelBucket = "cancelled"
+
+// how long cancel requests are kept to catch tasks still on their way
+const cancelRetention = 24 * time.Hour
+
+// cancel message on the control queue, it references either all
+// tasks of a request or the tasks of a sample, optionally limited
+// to one service
+type CancelRequest struct {
+	RequestID string    `json:"requestID"`
+	SHA256    string    `json:"sha256"`
+	Service   string    `json:"service"`
+	Reason    string    `json:"reason"`
+	Received  time.Time `json:"received"`
+}
+
+// cancel handlers registered by the modules
+type cancelHandlers struct {
+	mutex    sync.Mutex
+	handlers []func(cr *CancelRequest)
+}
+
+// Validate checks if the cancel request references any tasks.
+func (cr *CancelRequest) Validate() error {
+	if cr.RequestID == "" && cr.SHA256 == "" {
+		return errors.New("Neither requestID nor sha256 given")
+	}
+
+	return nil
+}
+
+// Matches checks if the task of service for req, whose sample has
+// one of the given hashes, is referenced by the cancel request.
+func (cr *CancelRequest) Matches(req *ExternalRequest, service string, hashes ...string) bool {
+	if cr.RequestID != "" && req.RequestID == cr.RequestID {
+		return cr.Service == "" || cr.Service == service
+	}
+
+	if cr.SHA256 == "" || (cr.Service != "" && cr.Service != service) {
+		return false
+	}
+
+	for _, h := range hashes {
+		if h != "" && h == cr.SHA256 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SampleHashes returns the hashes the work item can be cancelled by,
+// the SHA256 of the sample, or of the normalised URL, and the one of
+// the archive it was extracted from.
+func (r *FeedRequest) SampleHashes() []string {
+	return sampleHashes(r.Hashes, r.URLHash, r.Parent)
+}
+
+// SampleHashes returns the hashes the task can be cancelled by, see
+// FeedRequest.SampleHashes.
+func (r *InternalRequest) SampleHashes() []string {
+	return sampleHashes(r.Hashes, r.URLHash, r.Parent)
+}
+
+func sampleHashes(hashes *Hashes, urlHash string, parent *ArchiveParent) []string {
+	found := []string{urlHash}
+	if hashes != nil {
+		found = append(found, hashes.SHA256)
+	}
+
+	if parent != nil {
+		found = append(found, parent.SHA256)
+	}
+
+	return found
+}
+
+// Cancel stores the cancel request, so tasks which reach a module
+// later are still cancelled, and notifies the registered handlers.
+func (c *Ctx) Cancel(cr *CancelRequest) error {
+	cr.Received = time.Now()
+
+	// keys only need to be unique
+	key := strconv.FormatInt(cr.Received.UnixNano(), 10)
+	if err := c.Store.Put(cancelBucket, key, cr); err != nil {
+		return err
+	}
+
+	c.pruneCancelled()
+
+	c.cancels.mutex.Lock()
+	handlers := c.cancels.handlers
+	c.cancels.mutex.Unlock()
+
+	for _, fn := range handlers {
+		fn(cr)
+	}
+
+	return nil
+}
+
+// HandleCancel registers fn to be called for every cancel request.
+func (c *Ctx) HandleCancel(fn func(cr *CancelRequest)) {
+	c.cancels.mutex.Lock()
+	defer c.cancels.mutex.Unlock()
+
+	c.cancels.handlers = append(c.cancels.handlers, fn)
+}
+
+// Cancelled returns the cancel request referencing the task of
+// service for req, nil if there is none.
+func (c *Ctx) Cancelled(req *ExternalRequest, service string, hashes ...string) *CancelRequest {
+	var found *CancelRequest
+
+	err := c.Store.ForEach(cancelBucket, func(key string, value []byte) error {
+		cr := &CancelRequest{}
+		if err := json.Unmarshal(value, cr); err != nil {
+			return err
+		}
+
+		if cr.Matches(req, service, hashes...) {
+			found = cr
+		}
+
+		return nil
+	})
+	if err != nil {
+		c.Warning.Println("Could not read cancel requests:", err.Error())
+	}
+
+	return found
+}
+
+// CancelTask ends a cancelled task like ExpireTask, but reports the
+// cancelled outcome.
+func (c *Ctx) CancelTask(req *InternalRequest, cr *CancelRequest, msg *amqp.Delivery) {
+	reason := "cancelled"
+	if cr.Reason != "" {
+		reason += ": " + cr.Reason
+	}
+
+	c.endTask(OutcomeCancelled, reason, req, msg)
+}
+
+// pruneCancelled removes cancel requests older than the retention.
+func (c *Ctx) pruneCancelled() {
+	old := []string{}
+
+	c.Store.ForEach(cancelBucket, func(key string, value []byte) error {
+		cr := &CancelRequest{}
+		if err := json.Unmarshal(value, cr); err != nil || time.Since(cr.Received) > cancelRetention {
+			old = append(old, key)
+		}
+
+		return nil
+	})
+
+	for _, key := range old {
+		if err := c.Store.Delete(cancelBucket, key); err != nil {
+			c.Warning.Println("Could not remove cancel request:", err.Error())
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// lifecycle event of a task, published on the event exchange
+// whenever the state, progress or message of the task changes
+type Event struct {
+	Service  string
+	URL      string
+	TaskID   string
+	Previous string // state before the change
+	State    string
+	Progress int
+	Message  string
+	Time     time.Time
+	Request  *ExternalRequest
+}
+
+// setupEvents declares the event exchange if one is configured.
+func (c *Ctx) setupEvents() error {
+	if c.Config.EventExchange == "" {
+		return nil
+	}
+
+	channel, err := c.AmqpConn.Channel()
+	if err != nil {
+		return err
+	}
+
+	err = channel.ExchangeDeclare(
+		c.Config.EventExchange, // name
+		"topic",                // type
+		true,                   // durable
+		false,                  // auto-deleted
+		false,                  // internal
+		false,                  // no-wait
+		nil,                    // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	c.Events = channel
+	return nil
+}
+
+// PublishEvent publishes a change of the state of a task on the
+// event exchange, using "<service>.event.dynamic.totem" as routing
+// key. Events are best effort, failures are only logged.
+func (c *Ctx) PublishEvent(req *InternalRequest, previous string, state *TaskState) {
+	if c.Events == nil {
+		return
+	}
+
+	eventJ, err := json.Marshal(Event{
+		Service:  req.Service,
+		URL:      req.URL,
+		TaskID:   req.TaskID,
+		Previous: previous,
+		State:    state.State,
+		Progress: state.Progress,
+		Message:  state.Message,
+		Time:     state.Time,
+		Request:  req.OriginalRequest.Redacted(),
+	})
+	if err != nil {
+		c.Warning.Println("Could not encode event:", err.Error())
+		return
+	}
+
+	err = c.Events.Publish(
+		c.Config.EventExchange,             // exchange
+		req.Service+".event.dynamic.totem", // routing key
+		false,                              // mandatory
+		false,                              // immediate
+		amqp.Publishing{
+			ContentType: "application/json",
+			Body:        eventJ,
+		},
+	)
+	if err != nil {
+		c.Warning.Println("Could not publish event:", err.Error())
+	}
+}
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setupHTTP starts the http server of the planner if a binding is
+// configured. Modules can register their handlers on c.Mux.
+func (c *Ctx) setupHTTP() error {
+	if c.Config.HTTPBinding == "" {
+		return nil
+	}
+
+	if c.Config.PublicURL == "" {
+		return errors.New("PublicURL is missing")
+	}
+	c.Config.PublicURL = strings.TrimRight(c.Config.PublicURL, "/")
+
+	if c.Config.SigningKey == "" {
+		// without a configured key the signed urls are only
+		// valid until the planner is restarted
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+
+		c.Config.SigningKey = hex.EncodeToString(key)
+	}
+
+	if c.Config.SampleURLValidity <= 0 {
+		c.Config.SampleURLValidity = 600
+	}
+
+	listener, err := net.Listen("tcp", c.Config.HTTPBinding)
+	if err != nil {
+		return err
+	}
+
+	c.Mux = http.NewServeMux()
+	c.Mux.HandleFunc("/samples/", c.httpSample)
+
+	go func() {
+		c.Warning.Println("HTTP server stopped:", http.Serve(listener, c.Mux))
+	}()
+
+	c.Info.Println("Serving HTTP on", c.Config.HTTPBinding)
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the given parts
+// using the configured signing key.
+func (c *Ctx) Sign(parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(c.Config.SigningKey))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SampleURL returns a short-lived signed url under which services
+// can download the sample with the given name from /tmp/.
+func (c *Ctx) SampleURL(name string) (string, error) {
+	if c.Mux == nil {
+		return "", errors.New("HTTPBinding is not configured, can't serve samples")
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(time.Second*time.Duration(c.Config.SampleURLValidity)).Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", c.Sign("samples", name, expires))
+
+	return c.Config.PublicURL + "/samples/" + url.PathEscape(name) + "?" + query.Encode(), nil
+}
+
+// CallbackURL returns a new unguessable callback token and the url
+// under which services can report the completion of a task. The
+// token is signed, so it can be verified without knowing the task.
+func (c *Ctx) CallbackURL() (string, string, error) {
+	if c.Mux == nil {
+		return "", "", errors.New("HTTPBinding is not configured, can't receive callbacks")
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+
+	token := hex.EncodeToString(nonce)
+	token += "." + c.Sign("callback", token)
+
+	return token, c.Config.PublicURL + "/callback/" + token, nil
+}
+
+// ValidCallbackToken checks if token was created by CallbackURL.
+func (c *Ctx) ValidCallbackToken(token string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	return hmac.Equal([]byte(parts[1]), []byte(c.Sign("callback", parts[0])))
+}
+
+// Authorized checks if the request carries token as bearer token.
+// An empty token authorizes nothing.
+func Authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// httpSample serves a sample from /tmp/ if the url was signed by
+// SampleURL and did not expire yet.
+func (c *Ctx) httpSample(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/samples/")
+	if name == "" || name != filepath.Base(name) || !strings.HasPrefix(name, "totem-dynamic") {
+		http.NotFound(w, r)
+		return
+	}
+
+	expires := r.URL.Query().Get("expires")
+	signature := r.URL.Query().Get("signature")
+	if !hmac.Equal([]byte(signature), []byte(c.Sign("samples", name, expires))) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresUnix {
+		http.Error(w, "url expired", http.StatusForbidden)
+		return
+	}
+
+	f, err := os.Open("/tmp/" + name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Debug.Println("Serving sample", name, "to", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// version of the service protocol spoken by the planner, services
+// announcing a newer one are refused
+const ProtocolVersion = 1
+
+// optional features a service can announce in its info
+const (
+	FeatureBatchCheck = "batch-check" // /check/batch/
+	FeatureCallbacks  = "callbacks"   // notifies the callback url of a task
+	FeatureCancel     = "cancel"      // /cancel/
+	FeatureRelease    = "release"     // /release/, tasks are kept until released
+)
+
+// json return of info request, describes what a service is and
+// what it supports
+type Info struct {
+	Name            string
+	Version         string
+	ProtocolVersion int
+	ObjectTypes     []string // object types the service analyses, empty means all
+	AcceptedTypes   []string // file types the service analyses, nil means undeclared
+	Options         []string // task options the service supports, nil means unknown
+	Features        []string // the Feature* constants the service supports
+}
+
+// cached info of a service URL, Info is nil for services without an
+// info endpoint
+type cachedInfo struct {
+	info    *Info
+	fetched time.Time
+}
+
+// infos fetched from the services, keyed by URL
+type infoCache struct {
+	mutex sync.Mutex
+	infos map[string]*cachedInfo
+}
+
+// Supports checks if the service announced feature.
+func (i *Info) Supports(feature string) bool {
+	for _, f := range i.Features {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Accepts checks if the service analyses objects of objectType.
+func (i *Info) Accepts(objectType string) bool {
+	if len(i.ObjectTypes) == 0 {
+		return true
+	}
+
+	for _, t := range i.ObjectTypes {
+		if t == objectType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SupportsOption checks if the service supports the task option.
+func (i *Info) SupportsOption(option string) bool {
+	if i.Options == nil {
+		return true
+	}
+
+	for _, o := range i.Options {
+		if o == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Info gets the info of the service. Services without an info
+// endpoint return a nil Info and no error.
+func (s *Service) Info() (*Info, error) {
+	info := &Info{}
+	_, httpStatus, err := FastGet(s.Client, s.URL+"/info/", info)
+	if httpStatus == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if httpStatus != 200 && err == nil {
+		err = errors.New("Returned non-200 status code")
+	}
+
+	return info, err
+}
+
+// ServiceInfo returns the info of the service at url, fetched at most
+// every ServiceInfoTTL seconds. The info is validated against the
+// configuration. A nil Info means the service has no info endpoint,
+// none of the optional features is used then.
+func (c *Ctx) ServiceInfo(name, url string) (*Info, error) {
+	ttl := time.Second * time.Duration(c.Config.ServiceInfoTTL)
+	if ttl <= 0 {
+		ttl = time.Minute * 10
+	}
+
+	c.infos.mutex.Lock()
+	cached, ok := c.infos.infos[url]
+	c.infos.mutex.Unlock()
+
+	if ok && time.Since(cached.fetched) < ttl {
+		return cached.info, nil
+	}
+
+	info, err := c.NewService(name, url).Info()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateInfo(name, info); err != nil {
+		return nil, err
+	}
+
+	c.infos.mutex.Lock()
+	if c.infos.infos == nil {
+		c.infos.infos = make(map[string]*cachedInfo)
+	}
+	c.infos.infos[url] = &cachedInfo{info, time.Now()}
+	c.infos.mutex.Unlock()
+
+	return info, nil
+}
+
+// ServiceSupports checks if the service at url announced feature in
+// its info. If the info can't be fetched or there is none the feature
+// is treated as unsupported.
+func (c *Ctx) ServiceSupports(name, url, feature string) bool {
+	info, err := c.ServiceInfo(name, url)
+	if err != nil {
+		c.Warning.Println("Could not get the info of", url, "assuming it doesn't support", feature+":", err.Error())
+		return false
+	}
+
+	if info == nil {
+		return false
+	}
+
+	return info.Supports(feature)
+}
+
+// validateInfo checks if the info fits the service it is configured as.
+func validateInfo(name string, info *Info) error {
+	if info == nil {
+		return nil
+	}
+
+	if info.Name != name {
+		return errors.New("Service announces itself as " + info.Name + " but is configured as " + name)
+	}
+
+	if info.ProtocolVersion > ProtocolVersion {
+		return errors.New(name + " speaks protocol version " + strconv.Itoa(info.ProtocolVersion) + ", supported is " + strconv.Itoa(ProtocolVersion))
+	}
+
+	return nil
+}
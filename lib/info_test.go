@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServiceSupports(t *testing.T) {
+	withInfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&Info{Name: "cuckoo", ProtocolVersion: ProtocolVersion, Features: []string{FeatureCancel}})
+	}))
+	defer withInfo.Close()
+
+	withoutInfo := httptest.NewServer(http.NotFoundHandler())
+	defer withoutInfo.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		feature  string
+		supports bool
+	}{
+		{"announced", withInfo.URL, FeatureCancel, true},
+		{"not announced", withInfo.URL, FeatureRelease, false},
+		{"without info", withoutInfo.URL, FeatureCancel, false},
+		{"info failed", broken.URL, FeatureCancel, false},
+	}
+
+	c := &Ctx{
+		Config:  &Config{},
+		Client:  http.DefaultClient,
+		Warning: log.New(ioutil.Discard, "", 0),
+	}
+
+	for _, tt := range tests {
+		if supports := c.ServiceSupports("cuckoo", tt.url, tt.feature); supports != tt.supports {
+			t.Errorf("%s: expected %t, got %t", tt.name, tt.supports, supports)
+		}
+	}
+}
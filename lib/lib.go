@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -16,6 +17,9 @@ import (
 	"github.com/streadway/amqp"
 )
 
+// version of the planner, reported in the results
+const Version = "0.2.0"
+
 // general context struct
 type Ctx struct {
 	Config *Config
@@ -24,10 +28,22 @@ type Ctx struct {
 	Info    *log.Logger
 	Warning *log.Logger
 
-	AmqpConn *amqp.Connection
-	Client   *http.Client
-
-	Failed *QueueHandler
+	AmqpConn    *amqp.Connection
+	Client      *http.Client
+	Mux         *http.ServeMux // only set if HTTPBinding is configured
+	Sources     map[string]SampleSource
+	ResultStore ResultStore // only set if a results store is configured
+	Limits      *RateLimiter
+	Store       *Store
+
+	Failed   *QueueHandler
+	Outcomes *QueueHandler
+	Events   *amqp.Channel // only set if EventExchange is configured
+
+	cancels  cancelHandlers
+	files    workspace
+	infos    infoCache
+	registry registry
 }
 
 type Config struct {
@@ -36,6 +52,14 @@ type Config struct {
 	ConsumeQueue string
 	ResultsQueue string
 	FailedQueue  string
+	OutcomeQueue string
+
+	// fanout exchange for cancel requests, every node consumes them
+	// from its own queue
+	ControlExchange string
+
+	// topic exchange for lifecycle events of tasks, optional
+	EventExchange string
 
 	LogFile   string
 	LogLevel  string
@@ -43,19 +67,173 @@ type Config struct {
 
 	Services map[string][]string
 
+	// service instances can register themselves by posting heartbeats
+	// to /register/ or by publishing them on the RegistrationExchange,
+	// a fanout exchange every node consumes from its own queue. Both
+	// carry the RegistrationToken; a registration expires after
+	// RegistrationTimeout seconds without a heartbeat. Only services
+	// listed in Services can register unless AllowNewServices is set.
+	RegistrationToken    string
+	RegistrationExchange string
+	RegistrationTimeout  int
+	AllowNewServices     bool
+
+	// seconds the info of a service URL is cached
+	ServiceInfoTTL int
+
+	// rate limits by service name or URL, daily quotas are
+	// persisted in the QuotaFile
+	RateLimits map[string]*RateLimit
+	QuotaFile  string
+
+	// planner http server, used to hand out samples
+	HTTPBinding       string
+	PublicURL         string
+	SigningKey        string
+	SampleURLValidity int
+
+	// bearer token for the inspection endpoints like /tasks/, they
+	// are disabled without one
+	AdminToken string
+
+	// file types accepted per service, overrides what the service
+	// announces in its status; IncompatibleTypes is skip or fail
+	AcceptedTypes     map[string][]string
+	IncompatibleTypes string
+
+	// sample delivery per service: auto, shared, url or upload
+	Delivery map[string]string
+
+	// sample sources by URI scheme: http, https, file, s3, holmes
+	Sources map[string]*SourceConfig
+
 	// stuff for feed
 	FeedPrefetchCount int
 
+	// archive expansion in feed
+	ExpandArchives       bool
+	ArchivePasswords     []string
+	ArchiveMaxDepth      int
+	ArchiveMaxMembers    int
+	ArchiveMaxMemberSize int64
+	ArchiveMaxTotalSize  int64
+	SevenZipBinary       string
+
 	// stuff for check
 	CheckPrefetchCount  int
 	WaitBetweenRequests int
+	CheckWorkers        int // parallel checks per service
+	CheckBatchSize      int // tasks per batch check, 1 disables batches
+
+	// maximum analysis duration in seconds per service, counted from
+	// the moment a task was fed; with RefeedOnTimeout a timed out task
+	// is fed once more to another URL of the service
+	MaxAnalysisDuration map[string]int
+	RefeedOnTimeout     bool
+
+	// polling policy per service, services without one are
+	// checked every WaitBetweenRequests seconds
+	Polling map[string]*PollingPolicy
+
+	// tasks of services which notify their completion are only
+	// polled every CallbackFallbackInterval seconds
+	CallbackFallbackInterval int
+
+	StorePath string
 
 	// stuff for submit
 	SubmitPrefetchCount int
+
+	// results are compressed with ResultCompression ("gzip" or
+	// "zstd") if set, results larger than ResultOffloadSize bytes
+	// are kept in the ResultStore and only referenced
+	ResultCompression string
+	ResultOffloadSize int
+	ResultStore       *ResultStoreConfig
+
+	// publish results in the legacy format with the service results
+	// as a json string in Data, for consumers not updated yet
+	LegacyResults bool
+
+	// sinks the results are sent to in the given order, without any
+	// they are published on the "totem" exchange
+	ResultSinks []*ResultSinkConfig
+
+	// results are signed if ResultSigning is "hmac-sha256", with
+	// ResultSigningKey as shared key, or "ed25519", with the base64
+	// encoded private key in ResultSigningKey
+	ResultSigning      string
+	ResultSigningKey   string
+	ResultSigningKeyID string
+
+	// stuff for control
+	ControlPrefetchCount int
+
+	// every JanitorInterval seconds the totem-dynamic files in /tmp
+	// older than WorkspaceMaxAge seconds, which no task references,
+	// are removed; without WorkspaceMaxAge the janitor is disabled
+	WorkspaceMaxAge int
+	JanitorInterval int
+}
+
+// polling policy of a service, all durations are in seconds
+type PollingPolicy struct {
+	InitialDelay int     // expected duration of a task until one was learned
+	MinInterval  int     // interval once a task reached its expected duration
+	MaxInterval  int     // cap of the backoff and of the wait of young tasks
+	Backoff      float64 // factor the interval grows by with every check
+	Learn        bool    // learn the expected duration from completed tasks
+}
+
+// destination of the results, a sink only gets the results which
+// pass all of its filters, empty filters pass everything. A result
+// is only acknowledged once all required sinks took it over.
+type ResultSinkConfig struct {
+	Type     string // "amqp", "http" or "file"
+	Required bool
+
+	Services []string // service names
+	Sources  []string // sources of the requests
+	Tags     []string // the result has to carry one of them
+
+	// amqp, the routing key defaults to "<service>.result.static.totem"
+	Exchange   string
+	RoutingKey string
+
+	// http, every result is POSTed to URL with the given headers,
+	// failed posts are retried with a doubling wait
+	URL       string
+	Headers   map[string]string
+	Retries   int
+	RetryWait int // seconds before the first retry
+
+	// file, a json line per result, the file is rotated once it
+	// exceeds MaxSize bytes and MaxFiles rotated files are kept
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+}
+
+// types of the objects handed to the services
+const (
+	ObjectFile   = "file"
+	ObjectURL    = "url"
+	ObjectDomain = "domain"
+)
+
+// hashes of a sample file, computed once by feed
+type Hashes struct {
+	MD5    string `json:"md5"`
+	SHA1   string `json:"sha1"`
+	SHA256 string `json:"sha256"`
+	SHA512 string `json:"sha512"`
+	SSDeep string `json:"ssdeep"` // empty for files too small to hash
+	TLSH   string `json:"tlsh"`   // empty for files too small to hash
 }
 
 // request from the gateway to totem-dynamic
 type ExternalRequest struct {
+	RequestID    string              `json:"requestID"` // used to cancel the tasks of the request
 	PrimaryURI   string              `json:"primaryURI"`
 	SecondaryURI string              `json:"secondaryURI"`
 	Filename     string              `json:"filename"`
@@ -65,6 +243,65 @@ type ExternalRequest struct {
 	Download     bool                `json:"download"`
 	Source       string              `json:"source"`
 	Attempts     int                 `json:"attempts"`
+	Passwords    []string            `json:"passwords"`
+	Received     time.Time           `json:"received"` // set by feed when the request arrives
+	Deadline     time.Time           `json:"deadline"` // absolute deadline, RFC 3339
+	TTL          int                 `json:"ttl"`      // relative deadline in seconds
+}
+
+// WithoutPasswords returns the request without its archive passwords,
+// they are not forwarded once the archive was expanded.
+func (r *ExternalRequest) WithoutPasswords() *ExternalRequest {
+	if r == nil || r.Passwords == nil {
+		return r
+	}
+
+	stripped := *r
+	stripped.Passwords = nil
+	return &stripped
+}
+
+// Redacted returns the request without its archive passwords and
+// sample URIs, which might carry credentials, for publishing it in
+// events and outcomes.
+func (r *ExternalRequest) Redacted() *ExternalRequest {
+	if r == nil {
+		return nil
+	}
+
+	redacted := *r
+	redacted.Passwords = nil
+	redacted.PrimaryURI = ""
+	redacted.SecondaryURI = ""
+	return &redacted
+}
+
+// task name in ExternalRequest.Tasks which requests all services
+// that accept the file type of the sample
+const AllApplicable = "all"
+
+// work item inside of feed, one is created for every
+// service requested by an ExternalRequest
+type FeedRequest struct {
+	Service         string // a service name or AllApplicable
+	FileType        string // set once the sample was inspected
+	Options         map[string]string
+	LocalPath       string         // sample is already in /tmp, e.g. extracted from an archive
+	Parent          *ArchiveParent // set if the sample was extracted from an archive
+	ObjectType      string         // one of the Object* constants, set once the sample is prepared
+	Hashes          *Hashes        // of the sample file, set once it is prepared
+	NormalizedURL   string         // normalised URL or domain, empty for files
+	URLHash         string         // SHA256 of NormalizedURL
+	ExcludeURLs     []string       // service URLs which must not be used
+	Refed           bool           // the task timed out once already
+	OriginalRequest *ExternalRequest
+}
+
+// archive a sample was extracted from
+type ArchiveParent struct {
+	Filename string `json:"filename"`
+	SHA256   string `json:"sha256"`
+	Member   string `json:"member"` // path of the sample inside the archive
 }
 
 // request between feed/check/submit
@@ -73,10 +310,25 @@ type InternalRequest struct {
 	URL             string
 	TaskID          string
 	FilePath        string
+	Options         map[string]string
+	Parent          *ArchiveParent
+	FileType        string
+	ObjectType      string
+	Hashes          *Hashes // nil for URL and domain tasks
+	NormalizedURL   string  // normalised URL or domain, empty for files
+	URLHash         string  // SHA256 of NormalizedURL
+	Refed           bool
+	CallbackToken   string      // set if the service notifies completion
+	States          []TaskState // state transitions recorded so far
 	Started         time.Time
 	OriginalRequest *ExternalRequest
 }
 
+// Key identifies the task of the request across all services.
+func (r *InternalRequest) Key() string {
+	return r.Service + "|" + r.URL + "|" + r.TaskID
+}
+
 // Init prepares all fields of the given Ctx sturct and
 // returns an error if something went wrong. By default
 // you should panic if an error is returned.
@@ -90,6 +342,13 @@ func (c *Ctx) Init(cPath string) error {
 
 	c.setupLogging()
 
+	err = c.setupStore()
+	if err != nil {
+		return err
+	}
+
+	c.setupWorkspace()
+
 	c.Info.Println("Connecting to amqp server...")
 	c.AmqpConn, err = amqp.Dial(c.Config.Amqp)
 	if err != nil {
@@ -101,8 +360,38 @@ func (c *Ctx) Init(cPath string) error {
 		return err
 	}
 
+	c.Outcomes, err = c.SetupQueue(c.Config.OutcomeQueue)
+	if err != nil {
+		return err
+	}
+
+	err = c.setupEvents()
+	if err != nil {
+		return err
+	}
+
 	c.setupClient()
 
+	err = c.setupRateLimiter()
+	if err != nil {
+		return err
+	}
+
+	err = c.setupSources()
+	if err != nil {
+		return err
+	}
+
+	err = c.setupResultStore()
+	if err != nil {
+		return err
+	}
+
+	err = c.setupHTTP()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -129,6 +418,14 @@ func loadConfig(cPath string) (*Config, error) {
 		return conf, err
 	}
 
+	if conf.ControlExchange == "" {
+		conf.ControlExchange = "totem_dynamic_control"
+	}
+
+	if conf.OutcomeQueue == "" {
+		conf.OutcomeQueue = "totem_dynamic_outcomes"
+	}
+
 	// validate the suffix
 	if conf.QueueSuffix == "" {
 		err = errors.New("Suffix is missing")
@@ -213,6 +510,56 @@ func FastGet(c *http.Client, url string, structPointer interface{}) ([]byte, int
 	return respBody, resp.StatusCode, err
 }
 
+// FastPostFile uploads the file at path as multipart form together
+// with the given fields. The file is streamed, so it never has to
+// fit into memory. The return values are the same as for FastGet.
+func FastPostFile(c *http.Client, url string, fields map[string]string, fileField, path string, structPointer interface{}) ([]byte, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	body, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+
+	go func() {
+		for key, val := range fields {
+			if err := writer.WriteField(key, val); err != nil {
+				pipe.CloseWithError(err)
+				return
+			}
+		}
+
+		part, err := writer.CreateFormFile(fileField, filepath.Base(path))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+
+		pipe.CloseWithError(err)
+	}()
+
+	resp, err := c.Post(url, writer.FormDataContentType(), body)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer SafeResponseClose(resp)
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if structPointer != nil {
+		err = json.Unmarshal(respBody, structPointer)
+	}
+
+	return respBody, resp.StatusCode, err
+}
+
 func SafeResponseClose(r *http.Response) {
 	if r == nil {
 		return
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// outcome of tasks which ended with results
+const OutcomeSuccess = "success"
+
+// outcomes of tasks which did not end with results
+const (
+	OutcomeExpired   = "expired"
+	OutcomeTimedOut  = "timed out"
+	OutcomeCancelled = "cancelled"
+
+	// the task should have ended with one of the outcomes above,
+	// but the service could not stop it
+	OutcomeCancelFailed = "cancel failed"
+)
+
+// message published on the outcome queue
+type Outcome struct {
+	Outcome string
+	Reason  string
+	Service string
+	URL     string
+	TaskID  string
+	Time    time.Time
+	Request *ExternalRequest
+}
+
+// Expired checks if the deadline of the request passed.
+func (r *ExternalRequest) Expired() bool {
+	return !r.Deadline.IsZero() && time.Now().After(r.Deadline)
+}
+
+// ReportOutcome publishes the outcome of a task on the outcome queue.
+func (c *Ctx) ReportOutcome(outcome, reason string, req *InternalRequest) {
+	c.Info.Println("Task of", req.Service, "ended as", outcome+":", reason)
+
+	outcomeJ, err := json.Marshal(Outcome{
+		Outcome: outcome,
+		Reason:  reason,
+		Service: req.Service,
+		URL:     req.URL,
+		TaskID:  req.TaskID,
+		Time:    time.Now(),
+		Request: req.OriginalRequest.Redacted(),
+	})
+	if err != nil {
+		c.Warning.Println("Could not encode outcome:", err.Error())
+		return
+	}
+
+	if err := c.Outcomes.Send(outcomeJ); err != nil {
+		c.Warning.Println("Could not publish outcome:", err.Error())
+	}
+}
+
+// ExpireTask ends a task whose deadline passed. The task is cancelled
+// at the service if it was created already, the sample is removed,
+// the expired outcome is reported and msg, if given, is acked.
+func (c *Ctx) ExpireTask(req *InternalRequest, msg *amqp.Delivery) {
+	c.endTask(OutcomeExpired, "deadline "+req.OriginalRequest.Deadline.Format(time.RFC3339)+" passed", req, msg)
+}
+
+// StopTask cancels the task at the service if it was created already
+// and the service supports it. The returned outcome is the given one,
+// or OutcomeCancelFailed with the error added to the reason if the
+// service could not cancel the task.
+func (c *Ctx) StopTask(outcome, reason string, req *InternalRequest) (string, string) {
+	if req.TaskID == "" || !c.ServiceSupports(req.Service, req.URL, FeatureCancel) {
+		return outcome, reason
+	}
+
+	service := c.NewService(req.Service, req.URL)
+	if err := service.CancelTask(req.TaskID); err != nil {
+		c.Warning.Println("Cancelling", outcome, "task", req.TaskID, "at", req.URL, "failed:", err.Error())
+		return OutcomeCancelFailed, outcome + ", " + reason + ", cancelling failed: " + err.Error()
+	}
+
+	return outcome, reason
+}
+
+// endTask stops a task before it produced results, see ExpireTask.
+func (c *Ctx) endTask(outcome, reason string, req *InternalRequest, msg *amqp.Delivery) {
+	outcome, reason = c.StopTask(outcome, reason, req)
+
+	c.RemoveFile(req.SamplePath())
+
+	c.ReportOutcome(outcome, reason, req)
+
+	if msg == nil {
+		return
+	}
+
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
+	}
+}
@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// rate limit of a service or of a single service URL
+type RateLimit struct {
+	PerMinute float64 // calls per minute, 0 means unlimited
+	Burst     int     // calls which can be made at once, at least 1
+	PerDay    int     // daily quota, resets at midnight UTC, 0 means unlimited
+}
+
+// token bucket of a limited key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// calls made on a day, persisted in the quota file
+type quota struct {
+	Day  string
+	Used int
+}
+
+// RateLimiter enforces the configured rate limits and daily quotas.
+// Limits are keyed by service name or service URL, a call has to
+// satisfy the limits of all its keys.
+type RateLimiter struct {
+	mutex   sync.Mutex
+	limits  map[string]*RateLimit
+	buckets map[string]*bucket
+	quotas  map[string]*quota
+	file    string
+	warning *log.Logger
+}
+
+// setupRateLimiter creates the rate limiter of the context and loads
+// the daily quotas used so far.
+func (c *Ctx) setupRateLimiter() error {
+	c.Limits = &RateLimiter{
+		limits:  c.Config.RateLimits,
+		buckets: make(map[string]*bucket),
+		quotas:  make(map[string]*quota),
+		file:    c.Config.QuotaFile,
+		warning: c.Warning,
+	}
+
+	if c.Config.QuotaFile == "" {
+		return nil
+	}
+
+	quotaJ, err := ioutil.ReadFile(c.Config.QuotaFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(quotaJ, &c.Limits.quotas)
+}
+
+// Delay returns how long a call for the given keys would have to
+// wait. Nothing is consumed.
+func (r *RateLimiter) Delay(keys ...string) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.delay(time.Now(), keys)
+}
+
+// Take consumes a call for the given keys if the limits allow it
+// right now. Otherwise nothing is consumed and the delay until the
+// call would be allowed is returned.
+func (r *RateLimiter) Take(keys ...string) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	wait := r.delay(now, keys)
+	if wait > 0 {
+		if wait > time.Minute {
+			r.warning.Println("Quota of", keys, "is exhausted for another", wait)
+		}
+
+		return wait
+	}
+
+	r.consume(now, keys)
+	return 0
+}
+
+func (r *RateLimiter) delay(now time.Time, keys []string) time.Duration {
+	var wait time.Duration
+
+	for _, key := range keys {
+		limit, ok := r.limits[key]
+		if !ok {
+			continue
+		}
+
+		if limit.PerDay > 0 {
+			q := r.quotas[key]
+			if q != nil && q.Day == day(now) && q.Used >= limit.PerDay {
+				midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+				if d := midnight.Sub(now); d > wait {
+					wait = d
+				}
+			}
+		}
+
+		if limit.PerMinute > 0 {
+			tokens := r.refill(now, key, limit)
+			if tokens < 1 {
+				d := time.Duration((1 - tokens) / limit.PerMinute * float64(time.Minute))
+				if d > wait {
+					wait = d
+				}
+			}
+		}
+	}
+
+	return wait
+}
+
+func (r *RateLimiter) consume(now time.Time, keys []string) {
+	quotaChanged := false
+
+	for _, key := range keys {
+		limit, ok := r.limits[key]
+		if !ok {
+			continue
+		}
+
+		if limit.PerMinute > 0 {
+			r.refill(now, key, limit)
+			r.buckets[key].tokens -= 1
+		}
+
+		if limit.PerDay > 0 {
+			q := r.quotas[key]
+			if q == nil || q.Day != day(now) {
+				q = &quota{Day: day(now)}
+				r.quotas[key] = q
+			}
+
+			q.Used += 1
+			quotaChanged = true
+		}
+	}
+
+	if quotaChanged {
+		r.saveQuotas()
+	}
+}
+
+// refill adds the tokens gained since the last call to the bucket
+// of key and returns the current amount.
+func (r *RateLimiter) refill(now time.Time, key string, limit *RateLimit) float64 {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{burst, now}
+		r.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Minutes() * limit.PerMinute
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	return b.tokens
+}
+
+// saveQuotas writes the quotas to the quota file so they survive
+// restarts. The file is replaced atomically.
+func (r *RateLimiter) saveQuotas() {
+	if r.file == "" {
+		return
+	}
+
+	quotaJ, err := json.Marshal(r.quotas)
+	if err != nil {
+		r.warning.Println("Could not encode quotas:", err.Error())
+		return
+	}
+
+	err = ioutil.WriteFile(r.file+".tmp", quotaJ, 0600)
+	if err == nil {
+		err = os.Rename(r.file+".tmp", r.file)
+	}
+
+	if err != nil {
+		r.warning.Println("Could not save quotas:", err.Error())
+	}
+}
+
+func day(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(limits map[string]*RateLimit, file string) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*bucket),
+		quotas:  make(map[string]*quota),
+		file:    file,
+		warning: log.New(ioutil.Discard, "", 0),
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	start := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		limit *RateLimit
+		calls []time.Duration // offsets from start of calls which are made
+		at    time.Duration   // offset the delay is asked for
+		delay time.Duration
+	}{
+		{"unlimited", &RateLimit{}, []time.Duration{0, 0, 0}, 0, 0},
+		{"first call", &RateLimit{PerMinute: 1}, nil, 0, 0},
+		{"bucket empty", &RateLimit{PerMinute: 1}, []time.Duration{0}, 0, time.Minute},
+		{"bucket partly refilled", &RateLimit{PerMinute: 1}, []time.Duration{0}, 45 * time.Second, 15 * time.Second},
+		{"bucket refilled", &RateLimit{PerMinute: 1}, []time.Duration{0}, time.Minute, 0},
+		{"burst", &RateLimit{PerMinute: 2, Burst: 3}, []time.Duration{0, 0}, 0, 0},
+		{"burst used up", &RateLimit{PerMinute: 2, Burst: 3}, []time.Duration{0, 0, 0}, 0, 30 * time.Second},
+		{"refill capped by burst", &RateLimit{PerMinute: 60, Burst: 2}, []time.Duration{0, time.Hour, time.Hour}, time.Hour, time.Second},
+		{"quota left", &RateLimit{PerDay: 2}, []time.Duration{0}, 0, 0},
+		{"quota used up", &RateLimit{PerDay: 2}, []time.Duration{0, time.Hour}, 2 * time.Hour, 10 * time.Hour},
+		{"quota rolls over at midnight", &RateLimit{PerDay: 2}, []time.Duration{0, time.Hour}, 12 * time.Hour, 0},
+	}
+
+	for _, tt := range tests {
+		r := newTestLimiter(map[string]*RateLimit{"cuckoo": tt.limit}, "")
+
+		for _, offset := range tt.calls {
+			now := start.Add(offset)
+			if d := r.delay(now, []string{"cuckoo"}); d != 0 {
+				t.Fatalf("%s: call at %s was delayed by %s", tt.name, offset, d)
+			}
+			r.consume(now, []string{"cuckoo"})
+		}
+
+		if d := r.delay(start.Add(tt.at), []string{"cuckoo"}); d != tt.delay {
+			t.Errorf("%s: expected a delay of %s, got %s", tt.name, tt.delay, d)
+		}
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	now := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	r := newTestLimiter(map[string]*RateLimit{
+		"cuckoo":              {PerMinute: 10, Burst: 10},
+		"http://sandbox-1:80": {PerMinute: 1},
+	}, "")
+
+	keys := []string{"cuckoo", "http://sandbox-1:80"}
+	r.consume(now, keys)
+
+	// the stricter URL limit applies
+	if d := r.delay(now, keys); d != time.Minute {
+		t.Errorf("expected the URL limit of one minute, got %s", d)
+	}
+
+	// other URLs of the service only share its limit
+	if d := r.delay(now, []string{"cuckoo", "http://sandbox-2:80"}); d != 0 {
+		t.Errorf("expected no delay for another URL, got %s", d)
+	}
+}
+
+func TestTake(t *testing.T) {
+	r := newTestLimiter(map[string]*RateLimit{"cuckoo": {PerDay: 1}}, "")
+
+	if d := r.Take("cuckoo"); d != 0 {
+		t.Fatalf("expected the first call to be allowed, got a delay of %s", d)
+	}
+
+	// refused calls consume nothing
+	for i := 0; i < 2; i++ {
+		if d := r.Take("cuckoo"); d <= 0 {
+			t.Fatalf("expected the quota to be used up, got a delay of %s", d)
+		}
+	}
+
+	if q := r.quotas["cuckoo"]; q.Used != 1 {
+		t.Errorf("expected one call to be counted, got %d", q.Used)
+	}
+}
+
+func TestQuotaFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quota.json")
+	now := time.Date(2016, 6, 1, 23, 0, 0, 0, time.UTC)
+	limits := map[string]*RateLimit{"cuckoo": {PerDay: 1}}
+
+	r := newTestLimiter(limits, file)
+	r.consume(now, []string{"cuckoo"})
+
+	// a restarted limiter continues with the saved quota
+	quotaJ, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestLimiter(limits, file)
+	if err := json.Unmarshal(quotaJ, &restarted.quotas); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := restarted.delay(now, []string{"cuckoo"}); d != time.Hour {
+		t.Errorf("expected the quota to be used up until midnight, got a delay of %s", d)
+	}
+
+	// the next day starts with a new quota
+	tomorrow := now.Add(2 * time.Hour)
+	if d := restarted.delay(tomorrow, []string{"cuckoo"}); d != 0 {
+		t.Errorf("expected the quota to be reset, got a delay of %s", d)
+	}
+
+	restarted.consume(tomorrow, []string{"cuckoo"})
+	if q := restarted.quotas["cuckoo"]; q.Day != "2016-06-02" || q.Used != 1 {
+		t.Errorf("expected one call on 2016-06-02, got %d on %s", q.Used, q.Day)
+	}
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// announcement of a running service instance, sent periodically as
+// heartbeat to /register/ or on the RegistrationExchange
+type Registration struct {
+	Name     string    `json:"name"`
+	URL      string    `json:"url"`
+	Capacity int       `json:"capacity"`        // tasks the instance can take, informational
+	Leave    bool      `json:"leave"`           // the instance shuts down, remove it right away
+	Token    string    `json:"token,omitempty"` // RegistrationToken, required on the queue
+	LastSeen time.Time `json:"lastSeen"`        // set by the planner
+}
+
+// registered service instances, keyed by URL
+type registry struct {
+	mutex     sync.Mutex
+	instances map[string]*Registration
+}
+
+// Validate checks if the registration names a service and a usable URL.
+func (r *Registration) Validate() error {
+	if r.Name == "" {
+		return errors.New("No service name given")
+	}
+
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Invalid service URL " + r.URL)
+	}
+
+	return nil
+}
+
+// Register adds or refreshes a service instance, or removes it if it
+// leaves. Registrations expire after RegistrationTimeout seconds
+// without a heartbeat. Only services known from the configuration
+// can register, unless AllowNewServices is set. The caller has to
+// authenticate the registration.
+func (c *Ctx) Register(r *Registration) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	if _, known := c.Config.Services[r.Name]; !known && !c.Config.AllowNewServices {
+		return errors.New("Service " + r.Name + " is not configured")
+	}
+
+	c.registry.mutex.Lock()
+	defer c.registry.mutex.Unlock()
+
+	if c.registry.instances == nil {
+		c.registry.instances = make(map[string]*Registration)
+	}
+
+	known, ok := c.registry.instances[r.URL]
+	if ok && !c.registrationLive(known) {
+		ok = false
+	}
+
+	if r.Leave {
+		if ok {
+			c.Info.Println("Service", r.Name, "at", r.URL, "left")
+		}
+
+		delete(c.registry.instances, r.URL)
+		return nil
+	}
+
+	if !ok || known.Name != r.Name {
+		c.Info.Println("Service", r.Name, "registered at", r.URL)
+	}
+
+	reg := *r
+	reg.Token = ""
+	reg.LastSeen = time.Now()
+	c.registry.instances[r.URL] = &reg
+
+	return nil
+}
+
+// Registrations returns the live registrations and drops the expired ones.
+func (c *Ctx) Registrations() []Registration {
+	c.registry.mutex.Lock()
+	defer c.registry.mutex.Unlock()
+
+	live := []Registration{}
+	for u, r := range c.registry.instances {
+		if !c.registrationLive(r) {
+			c.Info.Println("Registration of", r.Name, "at", u, "expired")
+			delete(c.registry.instances, u)
+			continue
+		}
+
+		live = append(live, *r)
+	}
+
+	return live
+}
+
+// Services returns the URLs of all services, the statically
+// configured ones merged with the live registrations.
+func (c *Ctx) Services() map[string][]string {
+	services := make(map[string][]string, len(c.Config.Services))
+	for name, urls := range c.Config.Services {
+		services[name] = append([]string{}, urls...)
+	}
+
+	for _, r := range c.Registrations() {
+		known := false
+		for _, u := range services[r.Name] {
+			if u == r.URL {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			services[r.Name] = append(services[r.Name], r.URL)
+		}
+	}
+
+	return services
+}
+
+// registrationLive checks if the last heartbeat of r is recent enough.
+func (c *Ctx) registrationLive(r *Registration) bool {
+	timeout := c.Config.RegistrationTimeout
+	if timeout <= 0 {
+		timeout = 90
+	}
+
+	return time.Since(r.LastSeen) < time.Second*time.Duration(timeout)
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ResultStore keeps result payloads which are too large to be
+// published on the broker.
+type ResultStore interface {
+	// Put stores data under name and returns its location.
+	Put(name string, data []byte) (string, error)
+}
+
+// configuration of the results store, the s3 store uses the
+// credentials of the embedded SourceConfig
+type ResultStoreConfig struct {
+	Type   string // "file" or "s3"
+	Bucket string // s3 only
+	SourceConfig
+}
+
+// setupResultStore checks the result compression and creates the
+// configured results store.
+func (c *Ctx) setupResultStore() error {
+	switch c.Config.ResultCompression {
+	case "", "gzip", "zstd":
+	default:
+		return errors.New("Unknown result compression " + c.Config.ResultCompression)
+	}
+
+	conf := c.Config.ResultStore
+	if conf == nil {
+		return nil
+	}
+
+	switch conf.Type {
+	case "file":
+		if conf.Root == "" {
+			return errors.New("Root is missing for the file results store")
+		}
+
+		if err := os.MkdirAll(conf.Root, 0750); err != nil {
+			return err
+		}
+
+		c.ResultStore = &fileResultStore{conf.Root}
+	case "s3":
+		if conf.Bucket == "" {
+			return errors.New("Bucket is missing for the s3 results store")
+		}
+
+		s3Defaults(&conf.SourceConfig)
+		c.ResultStore = &s3ResultStore{&s3Source{&conf.SourceConfig, c.Client}, conf.Bucket}
+	default:
+		return errors.New("Unknown results store " + conf.Type)
+	}
+
+	return nil
+}
+
+// fileResultStore writes the payloads into a local directory,
+// usually one shared with the consumers of the results.
+type fileResultStore struct {
+	root string
+}
+
+func (s *fileResultStore) Put(name string, data []byte) (string, error) {
+	path := filepath.Join(s.root, filepath.Base(name))
+
+	// consumers must never see partial payloads
+	if err := ioutil.WriteFile(path+".tmp", data, 0640); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", err
+	}
+
+	return "file://" + path, nil
+}
+
+// s3ResultStore uploads the payloads into a bucket of an S3
+// compatible object store.
+type s3ResultStore struct {
+	*s3Source
+	bucket string
+}
+
+func (s *s3ResultStore) Put(name string, data []byte) (string, error) {
+	req, err := s.newRequest("PUT", s.bucket, name, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	s.sign(req, hex.EncodeToString(hash[:]))
+
+	body, err := doFetch(s.client, req)
+	if err != nil {
+		return "", err
+	}
+	body.Close()
+
+	return "s3://" + s.bucket + "/" + name, nil
+}
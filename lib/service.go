@@ -1,15 +1,37 @@
 package lib
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ways a sample can be handed to a service
+const (
+	DeliveryShared = "shared" // the service reads the sample from the shared /tmp
+	DeliveryURL    = "url"    // the service downloads the sample from the planner
+	DeliveryUpload = "upload" // the sample is uploaded together with the task
 )
 
 type Service struct {
-	Name   string
-	URL    string
-	Client *http.Client
+	Name     string
+	URL      string
+	Client   *http.Client
+	Limiter  *RateLimiter
+	Delivery string // one of the Delivery* constants, empty means shared
+}
+
+// sample handed to a service by NewTask
+type Sample struct {
+	Name string // file name in /tmp or, for URL tasks, the sample itself
+	Path string // local path of the file, used for uploads
+	URL  string // signed download url, used for url delivery
+
+	Callback string // url the service notifies on completion, optional
 }
 
 // json return of status request
@@ -17,24 +39,136 @@ type Status struct {
 	Degraded  bool
 	Error     string
 	FreeSlots int
+	Delivery  []string // supported delivery modes, empty means shared only
+	Callbacks bool     // the service notifies the callback url of a task
+
+	AcceptedTypes []string // file types the service can analyse, empty means all
 }
 
 // json return of feed request
 type NewTask struct {
-	Error  string
-	TaskID string
+	Error   string
+	TaskID  string
+	Options map[string]string // the options accepted by the service
+}
+
+// states of a task
+const (
+	StateSubmitted  = "submitted"  // handed to the service by feed
+	StateQueued     = "queued"     // waiting at the service
+	StateRunning    = "running"    // being analysed
+	StateProcessing = "processing" // analysis finished, results are prepared
+	StateDone       = "done"       // results are ready
+	StateFailed     = "failed"
+)
+
+// state of a task at a given time
+type TaskState struct {
+	State    string
+	Progress int    // percent, 0 if unknown
+	Message  string `json:",omitempty"`
+	Time     time.Time
 }
 
 // json return of check request
 type CheckTask struct {
+	Error    string
+	Done     bool
+	State    string // one of the State* constants, optional
+	Progress int    // percent, optional
+	Message  string // optional
+}
+
+// TaskState returns the state reported by the service. For services
+// which don't report a state it is derived from Done and Error.
+func (ct *CheckTask) TaskState() *TaskState {
+	state := &TaskState{
+		State:    ct.State,
+		Progress: ct.Progress,
+		Message:  ct.Message,
+		Time:     time.Now(),
+	}
+
+	switch {
+	case ct.Error != "":
+		state.State = StateFailed
+		state.Message = ct.Error
+	case ct.Done:
+		state.State = StateDone
+	case state.State == "":
+		state.State = StateRunning
+	}
+
+	return state
+}
+
+// json return of batch check request, services without a batch
+// endpoint don't return Tasks
+type CheckBatch struct {
 	Error string
+	Tasks map[string]*CheckTask // keyed by task ID
+}
+
+// returned by CheckTasks if the service has no batch endpoint
+var ErrBatchUnsupported = errors.New("Service does not support batch checks")
+
+// returned by the rate limited calls if the rate limits or quotas of
+// the service don't allow another call right now, the caller has to
+// try again after Delay
+var ErrRateLimited = errors.New("Rate limit of the service is reached")
+
+// json body services post to the callback url of a task
+type Callback struct {
 	Done  bool
+	Error string // set if the task failed
+}
+
+// json return of cancel request
+type CancelTask struct {
+	Error string
+}
+
+// json return of release request
+type ReleaseTask struct {
+	Error string
 }
 
 // json return of results request
 type TaskResults struct {
 	Error   string
 	Results interface{}
+	Version string // version of the analysis behind the service, optional
+}
+
+// NewService returns a Service for the given name and URL which
+// shares the http client and the rate limits of the context.
+func (c *Ctx) NewService(name, serviceURL string) *Service {
+	return &Service{
+		Name:    name,
+		URL:     serviceURL,
+		Client:  c.Client,
+		Limiter: c.Limits,
+	}
+}
+
+// Delay returns how long the next rate limited call to the
+// service would have to wait.
+func (s *Service) Delay() time.Duration {
+	if s.Limiter == nil {
+		return 0
+	}
+
+	return s.Limiter.Delay(s.Name, s.URL)
+}
+
+// take consumes a call from the rate limits, ErrRateLimited is
+// returned if they don't allow another call right now.
+func (s *Service) take() error {
+	if s.Limiter != nil && s.Limiter.Take(s.Name, s.URL) > 0 {
+		return ErrRateLimited
+	}
+
+	return nil
 }
 
 // Status gets the current status of the service and returns it
@@ -49,11 +183,114 @@ func (s *Service) Status() (*Status, error) {
 	return status, err
 }
 
-// NewTask sends a new task to the service and returns the result
-// as a NewTask struct.
-func (s *Service) NewTask(sample string) (*NewTask, error) {
+// ParseTaskArguments converts the argument list of a task, given
+// as "key=value" strings, into a map of options for the service.
+func ParseTaskArguments(args []string) (map[string]string, error) {
+	options := make(map[string]string)
+
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, errors.New("Malformed task argument " + arg + ", expected key=value")
+		}
+
+		options[key] = strings.TrimSpace(kv[1])
+	}
+
+	return options, nil
+}
+
+// NegotiateDelivery picks the delivery mode for a service. wanted is the
+// configured mode, supported the list the service announced in its
+// status. When no mode is configured (or "auto") modes which do not
+// need a shared /tmp are preferred, url delivery is only considered
+// if the planner serves samples.
+func NegotiateDelivery(wanted string, supported []string, canServe bool) (string, error) {
+	if len(supported) == 0 {
+		supported = []string{DeliveryShared}
+	}
+
+	isSupported := func(mode string) bool {
+		for _, s := range supported {
+			if s == mode {
+				return true
+			}
+		}
+		return false
+	}
+
+	if wanted != "" && wanted != "auto" {
+		if !isSupported(wanted) {
+			return "", errors.New("Delivery mode " + wanted + " is not supported by the service")
+		}
+
+		if wanted == DeliveryURL && !canServe {
+			return "", errors.New("Delivery mode url needs HTTPBinding to be configured")
+		}
+
+		return wanted, nil
+	}
+
+	if isSupported(DeliveryUpload) {
+		return DeliveryUpload, nil
+	}
+
+	if isSupported(DeliveryURL) && canServe {
+		return DeliveryURL, nil
+	}
+
+	if isSupported(DeliveryShared) {
+		return DeliveryShared, nil
+	}
+
+	return "", errors.New("No usable delivery mode")
+}
+
+// NewTask sends a new task together with its options to the service
+// and returns the result as a NewTask struct. How the sample reaches
+// the service depends on s.Delivery.
+func (s *Service) NewTask(sample *Sample, options map[string]string) (*NewTask, error) {
+	fields := map[string]string{
+		"obj": sample.Name,
+	}
+
+	if len(options) > 0 {
+		optionsJ, err := json.Marshal(options)
+		if err != nil {
+			return nil, err
+		}
+
+		fields["options"] = string(optionsJ)
+	}
+
+	if sample.Callback != "" {
+		fields["callback"] = sample.Callback
+	}
+
+	if err := s.take(); err != nil {
+		return nil, err
+	}
+
 	nt := &NewTask{}
-	_, httpStatus, err := FastGet(s.Client, s.URL+"/feed/?obj="+url.QueryEscape(sample), nt)
+	var httpStatus int
+	var err error
+
+	switch s.Delivery {
+	case DeliveryUpload:
+		_, httpStatus, err = FastPostFile(s.Client, s.URL+"/feed/", fields, "sample", sample.Path, nt)
+	case DeliveryURL:
+		fields["url"] = sample.URL
+		fallthrough
+	default:
+		query := url.Values{}
+		for key, val := range fields {
+			query.Set(key, val)
+		}
+
+		_, httpStatus, err = FastGet(s.Client, s.URL+"/feed/?"+query.Encode(), nt)
+	}
+
 	if httpStatus != 200 && err == nil {
 		err = errors.New("Returned non-200 status code")
 	}
@@ -69,6 +306,10 @@ func (s *Service) NewTask(sample string) (*NewTask, error) {
 // return the result as a CheckTask struct.
 func (s *Service) CheckTask(taskID string) (*CheckTask, error) {
 	ct := &CheckTask{}
+	if err := s.take(); err != nil {
+		return ct, err
+	}
+
 	_, httpStatus, err := FastGet(s.Client, s.URL+"/check/?taskid="+url.QueryEscape(taskID), ct)
 	if httpStatus != 200 && err == nil {
 		err = errors.New("Returned non-200 status code")
@@ -81,9 +322,44 @@ func (s *Service) CheckTask(taskID string) (*CheckTask, error) {
 	return ct, err
 }
 
+// CheckTasks gets the status of several tasks with a single request.
+// ErrBatchUnsupported is returned if the service has no batch
+// endpoint, the tasks have to be checked one by one then. Any other
+// error concerns the whole batch.
+func (s *Service) CheckTasks(taskIDs []string) (map[string]*CheckTask, error) {
+	if err := s.take(); err != nil {
+		return nil, err
+	}
+
+	cb := &CheckBatch{}
+	_, httpStatus, err := FastGet(s.Client, s.URL+"/check/batch/?taskids="+url.QueryEscape(strings.Join(taskIDs, ",")), cb)
+	switch httpStatus {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, ErrBatchUnsupported
+	}
+
+	if httpStatus != 200 && err == nil {
+		err = errors.New("Returned status code " + strconv.Itoa(httpStatus))
+	}
+
+	if cb.Error != "" {
+		err = errors.New(cb.Error)
+	}
+
+	if err == nil && cb.Tasks == nil {
+		err = errors.New("Batch check returned no tasks")
+	}
+
+	return cb.Tasks, err
+}
+
 // TaskResults collects the results for a given task from the service
 // and returns them as a TaskResults struct.
 func (s *Service) TaskResults(taskID string) (*TaskResults, error) {
+	if err := s.take(); err != nil {
+		return nil, err
+	}
+
 	tr := &TaskResults{}
 	_, httpStatus, err := FastGet(s.Client, s.URL+"/results/?taskid="+url.QueryEscape(taskID), tr)
 	if httpStatus != 200 && err == nil {
@@ -96,3 +372,40 @@ func (s *Service) TaskResults(taskID string) (*TaskResults, error) {
 
 	return tr, err
 }
+
+// ReleaseTask tells the service that the results of a task were
+// taken over, so it can remove the task. Services which remove
+// tasks when their results are fetched have no release endpoint,
+// for them this is a no-op.
+func (s *Service) ReleaseTask(taskID string) error {
+	rt := &ReleaseTask{}
+	_, httpStatus, err := FastGet(s.Client, s.URL+"/release/?taskid="+url.QueryEscape(taskID), rt)
+	if httpStatus == http.StatusNotFound {
+		return nil
+	}
+
+	if httpStatus != 200 && err == nil {
+		err = errors.New("Returned non-200 status code")
+	}
+
+	if rt.Error != "" {
+		err = errors.New(rt.Error)
+	}
+
+	return err
+}
+
+// CancelTask stops a task at the service and removes it there.
+func (s *Service) CancelTask(taskID string) error {
+	ct := &CancelTask{}
+	_, httpStatus, err := FastGet(s.Client, s.URL+"/cancel/?taskid="+url.QueryEscape(taskID), ct)
+	if httpStatus != 200 && err == nil {
+		err = errors.New("Returned non-200 status code")
+	}
+
+	if ct.Error != "" {
+		err = errors.New(ct.Error)
+	}
+
+	return err
+}
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateDelivery(t *testing.T) {
+	all := []string{DeliveryShared, DeliveryURL, DeliveryUpload}
+
+	tests := []struct {
+		name      string
+		wanted    string
+		supported []string
+		canServe  bool
+		mode      string // empty if an error is expected
+	}{
+		{"old service", "", nil, true, DeliveryShared},
+		{"upload preferred", "", all, true, DeliveryUpload},
+		{"auto", "auto", all, true, DeliveryUpload},
+		{"url before shared", "", []string{DeliveryShared, DeliveryURL}, true, DeliveryURL},
+		{"url needs serving", "", []string{DeliveryShared, DeliveryURL}, false, DeliveryShared},
+		{"only url without serving", "", []string{DeliveryURL}, false, ""},
+		{"configured", DeliveryShared, all, true, DeliveryShared},
+		{"configured url", DeliveryURL, all, true, DeliveryURL},
+		{"configured url without serving", DeliveryURL, all, false, ""},
+		{"configured but unsupported", DeliveryUpload, []string{DeliveryShared}, true, ""},
+		{"configured for an old service", DeliveryUpload, nil, true, ""},
+		{"nothing known", "", []string{"carrier pigeon"}, true, ""},
+	}
+
+	for _, tt := range tests {
+		mode, err := NegotiateDelivery(tt.wanted, tt.supported, tt.canServe)
+		if tt.mode == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", tt.name, mode)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if mode != tt.mode {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.mode, mode)
+		}
+	}
+}
+
+func TestParseTaskArguments(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		options map[string]string // nil if an error is expected
+	}{
+		{"none", nil, map[string]string{}},
+		{"options", []string{"timeout=300", "package=exe"}, map[string]string{"timeout": "300", "package": "exe"}},
+		{"spaces are trimmed", []string{" timeout = 300 "}, map[string]string{"timeout": "300"}},
+		{"value with equal signs", []string{"options=a=1,b=2"}, map[string]string{"options": "a=1,b=2"}},
+		{"empty value", []string{"tags="}, map[string]string{"tags": ""}},
+		{"last one wins", []string{"timeout=1", "timeout=2"}, map[string]string{"timeout": "2"}},
+		{"no value", []string{"timeout"}, nil},
+		{"no key", []string{"=300"}, nil},
+		{"blank key", []string{" =300"}, nil},
+		{"one malformed", []string{"timeout=300", "package"}, nil},
+	}
+
+	for _, tt := range tests {
+		options, err := ParseTaskArguments(tt.args)
+		if tt.options == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", tt.name, options)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(options, tt.options) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.options, options)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SampleSource fetches samples from one kind of location, the
+// sources are registered by the scheme of the sample URI.
+type SampleSource interface {
+	Fetch(uri *url.URL) (io.ReadCloser, error)
+}
+
+// configuration of a sample source, which fields are used
+// depends on the scheme the source is registered for
+type SourceConfig struct {
+	// http, https and holmes
+	Headers  map[string]string
+	Username string
+	Password string
+	Hosts    []string // hosts the credentials are sent to, the URL of holmes is added
+
+	// file
+	Root string
+
+	// s3
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// holmes
+	URL string
+}
+
+var sha256Regex = regexp.MustCompile("^[a-fA-F0-9]{64}$")
+
+// setupSources creates the sample sources for all supported schemes.
+// http and https are always available, all others only if they are
+// configured.
+func (c *Ctx) setupSources() error {
+	c.Sources = make(map[string]SampleSource)
+
+	for _, scheme := range []string{"http", "https"} {
+		conf := c.Config.Sources[scheme]
+		if conf == nil {
+			conf = &SourceConfig{}
+		}
+
+		c.Sources[scheme] = &httpSource{conf, c.Client, conf.Hosts}
+	}
+
+	for scheme, conf := range c.Config.Sources {
+		switch scheme {
+		case "http", "https":
+			// already set up
+		case "file":
+			if conf.Root == "" {
+				return errors.New("Root is missing for the file source")
+			}
+
+			c.Sources[scheme] = &fileSource{conf}
+		case "s3":
+			s3Defaults(conf)
+			c.Sources[scheme] = &s3Source{conf, c.Client}
+		case "holmes":
+			if conf.URL == "" {
+				return errors.New("URL is missing for the holmes source")
+			}
+			conf.URL = strings.TrimRight(conf.URL, "/")
+
+			u, err := url.Parse(conf.URL)
+			if err != nil {
+				return err
+			}
+
+			c.Sources[scheme] = &holmesSource{&httpSource{conf, c.Client, append([]string{u.Host}, conf.Hosts...)}}
+		default:
+			return errors.New("Unknown sample source " + scheme)
+		}
+	}
+
+	return nil
+}
+
+// FetchSample opens the sample behind the given URI using the
+// source registered for its scheme. The caller has to close the
+// returned reader.
+func (c *Ctx) FetchSample(uri string) (io.ReadCloser, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	source, ok := c.Sources[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, errors.New("No sample source for " + u.Scheme + " configured")
+	}
+
+	return source.Fetch(u)
+}
+
+// httpSource fetches samples with a plain http(s) GET. The
+// configured credentials are only sent to the given hosts.
+type httpSource struct {
+	conf   *SourceConfig
+	client *http.Client
+	hosts  []string
+}
+
+func (s *httpSource) Fetch(uri *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", uri.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.trusted(uri) {
+		return doFetch(s.client, req)
+	}
+
+	for key, val := range s.conf.Headers {
+		req.Header.Set(key, val)
+	}
+
+	if s.conf.Username != "" {
+		req.SetBasicAuth(s.conf.Username, s.conf.Password)
+	}
+
+	// redirects would carry the credentials along, so they have to
+	// stay on a trusted host
+	client := *s.client
+	client.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		if !s.trusted(r.URL) {
+			return errors.New("Refusing redirect with credentials to " + r.URL.Host)
+		}
+
+		if len(via) >= 10 {
+			return errors.New("Stopped after 10 redirects")
+		}
+
+		return nil
+	}
+
+	return doFetch(&client, req)
+}
+
+// trusted checks if the credentials may be sent to the host of uri.
+func (s *httpSource) trusted(uri *url.URL) bool {
+	for _, host := range s.hosts {
+		if strings.EqualFold(host, uri.Host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileSource reads samples from a local directory, e.g. a NFS share.
+// Only files below the configured root are handed out, symlinks are
+// resolved before, so they can't point outside of it.
+type fileSource struct {
+	conf *SourceConfig
+}
+
+func (s *fileSource) Fetch(uri *url.URL) (io.ReadCloser, error) {
+	root, err := filepath.Abs(s.conf.Root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Clean(uri.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return nil, errors.New(uri.Path + " is outside of the configured root")
+	}
+
+	return os.Open(path)
+}
+
+// holmesSource fetches samples by their SHA256 from Holmes-Storage.
+type holmesSource struct {
+	*httpSource
+}
+
+func (s *holmesSource) Fetch(uri *url.URL) (io.ReadCloser, error) {
+	// holmes://<sha256> puts the hash into the host part
+	hash := uri.Host + strings.Trim(uri.Path, "/")
+	if !sha256Regex.MatchString(hash) {
+		return nil, errors.New(hash + " is not a valid SHA256")
+	}
+
+	u, err := url.Parse(s.conf.URL + "/samples/" + strings.ToLower(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.httpSource.Fetch(u)
+}
+
+// s3Source fetches samples from S3 compatible object stores,
+// s3://<bucket>/<key> is requested path-style from the endpoint.
+type s3Source struct {
+	conf   *SourceConfig
+	client *http.Client
+}
+
+func (s *s3Source) Fetch(uri *url.URL) (io.ReadCloser, error) {
+	req, err := s.newRequest("GET", uri.Host, uri.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sign(req, emptySHA256)
+
+	return doFetch(s.client, req)
+}
+
+// s3Defaults fills in the region and endpoint of AWS if they are
+// not configured.
+func s3Defaults(conf *SourceConfig) {
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+
+	if conf.Endpoint == "" {
+		conf.Endpoint = "https://s3." + conf.Region + ".amazonaws.com"
+	}
+	conf.Endpoint = strings.TrimRight(conf.Endpoint, "/")
+}
+
+// sha256 of an empty payload
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// newRequest builds a request for the given object in the bucket.
+func (s *s3Source) newRequest(method, bucket, key string, body io.Reader) (*http.Request, error) {
+	path := "/" + bucket + "/" + strings.TrimLeft(key, "/")
+	return http.NewRequest(method, s.conf.Endpoint+s3Escape(path), body)
+}
+
+// sign adds an AWS signature version 4 to the request, payloadHash
+// is the hex encoded SHA256 of the request body.
+func (s *s3Source) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.conf.Region + "/s3/aws4_request"
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	key := []byte("AWS4" + s.conf.SecretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.conf.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape encodes a path the way the AWS signature expects it,
+// everything except unreserved characters and slashes is escaped.
+func s3Escape(path string) string {
+	escaped := ""
+	for _, b := range []byte(path) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			escaped += string(b)
+		} else {
+			escaped += "%" + strings.ToUpper(hex.EncodeToString([]byte{b}))
+		}
+	}
+
+	return escaped
+}
+
+// doFetch performs the request and returns the body if the
+// response status is 200.
+func doFetch(c *http.Client, req *http.Request) (io.ReadCloser, error) {
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		SafeResponseClose(resp)
+		return nil, errors.New(req.URL.Host + " returned " + resp.Status)
+	}
+
+	return resp.Body, nil
+}
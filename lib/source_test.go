@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "samples")
+	outside := filepath.Join(dir, "secret")
+
+	for _, d := range []string{root, filepath.Join(root, "sub")} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{filepath.Join(root, "sub", "sample"), outside} {
+		if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(root, "escape"):    outside,
+		filepath.Join(root, "escapedir"): dir,
+		filepath.Join(root, "inside"):    filepath.Join(root, "sub", "sample"),
+		filepath.Join(dir, "rootlink"):   root,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		root  string
+		path  string
+		found bool
+	}{
+		{"sample", root, root + "/sub/sample", true},
+		{"link inside of the root", root, root + "/inside", true},
+		{"root is a link", filepath.Join(dir, "rootlink"), root + "/sub/sample", true},
+		{"path through a linked root", root, dir + "/rootlink/sub/sample", true},
+		{"outside", root, outside, false},
+		{"dot dot", root, root + "/../secret", false},
+		{"link to a file outside", root, root + "/escape", false},
+		{"link to a directory outside", root, root + "/escapedir/secret", false},
+		{"missing", root, root + "/missing", false},
+	}
+
+	for _, tt := range tests {
+		s := &fileSource{&SourceConfig{Root: tt.root}}
+
+		f, err := s.Fetch(&url.URL{Scheme: "file", Path: tt.path})
+		if err == nil {
+			f.Close()
+		}
+
+		if found := err == nil; found != tt.found {
+			t.Errorf("%s: expected found to be %t, got error %v", tt.name, tt.found, err)
+		}
+	}
+}
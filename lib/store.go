@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store is an embedded key/value store which keeps state across
+// restarts of the planner. Values are stored as json in buckets.
+type Store struct {
+	db *bolt.DB
+}
+
+// setupStore opens the store at the configured path. Without a path
+// the store is placed next to the binary.
+func (c *Ctx) setupStore() error {
+	path := c.Config.StorePath
+	if path == "" {
+		path, _ = filepath.Abs(filepath.Dir(os.Args[0]))
+		path += "/totem-dynamic.db"
+	}
+
+	store, err := OpenStore(path)
+	if err != nil {
+		return err
+	}
+
+	c.Store = store
+	return nil
+}
+
+// OpenStore opens the store at path, it is created if missing.
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{db}, nil
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Put stores value under key in bucket, an existing value is replaced.
+func (s *Store) Put(bucket, key string, value interface{}) error {
+	valueJ, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), valueJ)
+	})
+}
+
+// Get loads the value of key in bucket into value and reports
+// whether the key exists.
+func (s *Store) Get(bucket, key string, value interface{}) (bool, error) {
+	var valueJ []byte
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		// the slice is only valid during the transaction
+		if v := b.Get([]byte(key)); v != nil {
+			valueJ = append([]byte{}, v...)
+		}
+
+		return nil
+	})
+	if err != nil || valueJ == nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(valueJ, value)
+}
+
+// Delete removes key from bucket, missing keys are ignored.
+func (s *Store) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+// ForEach calls fn with every key and raw json value in bucket.
+// fn must not modify the store.
+func (s *Store) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
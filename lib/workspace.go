@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// directory and name prefix of the samples and extracted files
+const (
+	workspaceDir    = "/tmp/"
+	workspacePrefix = "totem-dynamic"
+)
+
+// bucket of the store holding the files referenced by queued tasks
+const workspaceBucket = "workspace"
+
+// claim of a file which was handed over to another module through
+// a queue, it lasts until the task ends
+type fileClaim struct {
+	Claimed time.Time
+}
+
+// files in use by this process and sources of files referenced by
+// the in-flight tasks of the modules
+type workspace struct {
+	mutex      sync.Mutex
+	inUse      map[string]int // by file name
+	referenced []func() []string
+}
+
+// setupWorkspace starts the janitor if WorkspaceMaxAge is configured.
+func (c *Ctx) setupWorkspace() {
+	c.files.inUse = make(map[string]int)
+
+	if c.Config.WorkspaceMaxAge <= 0 {
+		return
+	}
+
+	interval := c.Config.JanitorInterval
+	if interval <= 0 {
+		interval = 3600
+	}
+
+	go c.janitor(time.Second * time.Duration(interval))
+}
+
+// SamplePath returns the path of the sample of the task in /tmp, an
+// empty string if the sample was not downloaded.
+func (r *InternalRequest) SamplePath() string {
+	if !r.OriginalRequest.Download || r.FilePath == "" {
+		return ""
+	}
+
+	return workspaceDir + r.FilePath
+}
+
+// UseFile marks a new file in /tmp as in use by a task of this
+// process until it is handed over or removed.
+func (c *Ctx) UseFile(path string) {
+	c.files.mutex.Lock()
+	defer c.files.mutex.Unlock()
+
+	c.files.inUse[filepath.Base(path)]++
+}
+
+// HandOverFile claims the file for the task it is sent to through a
+// queue, the claim lasts until the file is removed.
+func (c *Ctx) HandOverFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	name := filepath.Base(path)
+	if err := c.Store.Put(workspaceBucket, name, &fileClaim{time.Now()}); err != nil {
+		return err
+	}
+
+	c.files.mutex.Lock()
+	defer c.files.mutex.Unlock()
+
+	if c.files.inUse[name]--; c.files.inUse[name] <= 0 {
+		delete(c.files.inUse, name)
+	}
+
+	return nil
+}
+
+// RemoveFile deletes a file in /tmp once its task ended, whatever the
+// outcome, and drops all marks and claims of it. Files which are
+// already gone are ignored.
+func (c *Ctx) RemoveFile(path string) {
+	if path == "" {
+		return
+	}
+
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, workspacePrefix) {
+		return
+	}
+
+	if err := os.Remove(workspaceDir + name); err != nil && !os.IsNotExist(err) {
+		c.Warning.Printf("Could not delete file %s: %s\n", name, err.Error())
+	}
+
+	c.files.mutex.Lock()
+	delete(c.files.inUse, name)
+	c.files.mutex.Unlock()
+
+	if err := c.Store.Delete(workspaceBucket, name); err != nil {
+		c.Warning.Println("Could not drop the claim of", name+":", err.Error())
+	}
+}
+
+// ReferenceFiles registers fn to report the files of the in-flight
+// tasks of a module to the janitor.
+func (c *Ctx) ReferenceFiles(fn func() []string) {
+	c.files.mutex.Lock()
+	defer c.files.mutex.Unlock()
+
+	c.files.referenced = append(c.files.referenced, fn)
+}
+
+// janitor removes the totem-dynamic files and directories in /tmp
+// which are older than WorkspaceMaxAge and not referenced by any
+// task, it never returns.
+func (c *Ctx) janitor(interval time.Duration) {
+	maxAge := time.Second * time.Duration(c.Config.WorkspaceMaxAge)
+
+	for {
+		entries, err := ioutil.ReadDir(workspaceDir)
+		if err != nil {
+			c.Warning.Println("Janitor could not list the workspace:", err.Error())
+		}
+
+		referenced := c.referencedFiles()
+		for name := range c.pruneClaims(maxAge, referenced) {
+			referenced[name] = true
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasPrefix(name, workspacePrefix) || referenced[name] || time.Since(entry.ModTime()) < maxAge {
+				continue
+			}
+
+			c.Info.Println("Janitor removes orphaned", name)
+			if err := os.RemoveAll(workspaceDir + name); err != nil {
+				c.Warning.Println("Janitor could not remove", name+":", err.Error())
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// referencedFiles returns the names of all files in use or reported
+// by a module.
+func (c *Ctx) referencedFiles() map[string]bool {
+	referenced := make(map[string]bool)
+
+	c.files.mutex.Lock()
+	for name := range c.files.inUse {
+		referenced[name] = true
+	}
+	fns := c.files.referenced
+	c.files.mutex.Unlock()
+
+	for _, fn := range fns {
+		for _, path := range fn() {
+			referenced[filepath.Base(path)] = true
+		}
+	}
+
+	return referenced
+}
+
+// pruneClaims drops the claims of files which are gone and the claims
+// older than maxAge of files no module references anymore, e.g.
+// because the process crashed before the task was sent or its
+// message was nacked. The remaining claims are returned.
+func (c *Ctx) pruneClaims(maxAge time.Duration, referenced map[string]bool) map[string]bool {
+	claimed := make(map[string]bool)
+	gone := []string{}
+
+	c.Store.ForEach(workspaceBucket, func(key string, value []byte) error {
+		claim := &fileClaim{}
+		if err := json.Unmarshal(value, claim); err != nil {
+			gone = append(gone, key)
+			return nil
+		}
+
+		if _, err := os.Stat(workspaceDir + key); os.IsNotExist(err) {
+			gone = append(gone, key)
+			return nil
+		}
+
+		if !referenced[key] && time.Since(claim.Claimed) > maxAge {
+			c.Info.Println("Claim of", key, "expired")
+			gone = append(gone, key)
+			return nil
+		}
+
+		claimed[key] = true
+		return nil
+	})
+
+	for _, key := range gone {
+		if err := c.Store.Delete(workspaceBucket, key); err != nil {
+			c.Warning.Println("Could not drop the claim of", key+":", err.Error())
+		}
+	}
+
+	return claimed
+}
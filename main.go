@@ -4,6 +4,7 @@ import (
 	"flag"
 
 	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/check"
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/control"
 	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/feed"
 	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
 	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/submit"
@@ -30,6 +31,11 @@ func main() {
 		panic(err.Error())
 	}
 
+	err = control.Run(ctx, false)
+	if err != nil {
+		panic(err.Error())
+	}
+
 	err = submit.Run(ctx, true)
 	if err != nil {
 		panic(err.Error())
@@ -18,6 +18,7 @@ type Cuckoo struct {
 }
 
 type Status struct {
+	Version   string           `json:"version"`
 	Tasks     *StatusTasks     `json:"tasks"`
 	Diskspace *StatusDiskspace `json:"diskspace"`
 }
@@ -50,6 +51,15 @@ type TasksViewTask struct {
 	Status string `json:"status"`
 }
 
+type TasksListResp struct {
+	Tasks []*TasksListTask `json:"tasks"`
+}
+
+type TasksListTask struct {
+	Id     int    `json:"id"`
+	Status string `json:"status"`
+}
+
 type TasksReport struct {
 	Info       *TasksReportInfo        `json:"info"`
 	Signatures []*TasksReportSignature `json;"signatures"`
@@ -235,6 +245,25 @@ func (c *Cuckoo) TaskStatus(id int) (string, error) {
 	return r.Task.Status, nil
 }
 
+// TaskList returns the status of up to limit tasks with a single call.
+func (c *Cuckoo) TaskList(limit int) ([]*TasksListTask, error) {
+	r := &TasksListResp{}
+	resp, status, err := c.fastGet(fmt.Sprintf("/tasks/list/%d", limit), r)
+	if err != nil || status != 200 {
+		if err == nil {
+			err = errors.New("no-200 ret")
+		}
+
+		if resp != nil {
+			err = errors.New(fmt.Sprintf("%s -> [%d] %s", err.Error(), status, resp))
+		}
+
+		return nil, err
+	}
+
+	return r.Tasks, nil
+}
+
 func (c *Cuckoo) TaskReport(id int) (*TasksReport, error) {
 	r := &TasksReport{}
 	resp, status, err := c.fastGet(fmt.Sprintf("/tasks/report/%d", id), r)
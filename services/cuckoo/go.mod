@@ -0,0 +1,3 @@
+module cuckoo
+
+go 1.22
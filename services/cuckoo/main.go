@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"cuckoo/cuckoo"
@@ -21,32 +27,94 @@ type Config struct {
 	MaxAPICalls    int
 	LogFile        string
 	LogLevel       string
+	AcceptedTypes  []string
+
+	// seconds between the status checks of tasks with a callback,
+	// a task is watched for at most WatchTimeout seconds
+	CallbackInterval int
+	WatchTimeout     int
+
+	// tasks fetched from cuckoo for a batch check, tasks not among
+	// them are looked up one by one
+	BatchListLimit int
+
+	// if PlannerURL is set the service registers itself there every
+	// HeartbeatInterval seconds under PublicURL
+	PlannerURL        string
+	PublicURL         string
+	RegistrationToken string
+	HeartbeatInterval int
 }
 
 type Ctx struct {
 	Config *Config
 	Cuckoo *cuckoo.Cuckoo
+	Client *http.Client // used to download samples from the planner
 }
 
 type RespStatus struct {
-	Degraded  bool
-	Error     string
-	FreeSlots int
+	Degraded      bool
+	Error         string
+	FreeSlots     int
+	Delivery      []string
+	Callbacks     bool
+	AcceptedTypes []string
+}
+
+type RespInfo struct {
+	Name            string
+	Version         string
+	ProtocolVersion int
+	ObjectTypes     []string
+	AcceptedTypes   []string
+	Options         []string
+	Features        []string
 }
 
 type RespNewTask struct {
-	Error  string
-	TaskID string
+	Error   string
+	TaskID  string
+	Options map[string]string
 }
 
 type RespCheckTask struct {
+	Error    string
+	Done     bool
+	State    string
+	Progress int
+	Message  string
+}
+
+type RespCheckBatch struct {
+	Error string
+	Tasks map[string]*RespCheckTask
+}
+
+type RespCancelTask struct {
+	Error string
+}
+
+type RespReleaseTask struct {
 	Error string
+}
+
+// posted to /register/ of the planner
+type ReqRegistration struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Capacity int    `json:"capacity"`
+}
+
+// posted to the callback url of a task
+type ReqCallback struct {
 	Done  bool
+	Error string
 }
 
 type RespTaskResults struct {
 	Error   string
 	Results interface{}
+	Version string
 }
 
 // TODO: Replace this with our own schema es soon as we have one
@@ -58,6 +126,21 @@ type CrtResult struct {
 
 var (
 	ctx *Ctx
+
+	// task options which are handed to cuckoo's tasks/create/file
+	allowedOptions = map[string]bool{
+		"package":         true,
+		"timeout":         true,
+		"priority":        true,
+		"options":         true,
+		"machine":         true,
+		"platform":        true,
+		"tags":            true,
+		"custom":          true,
+		"memory":          true,
+		"enforce_timeout": true,
+		"clock":           true,
+	}
 )
 
 func main() {
@@ -83,28 +166,113 @@ func main() {
 	}
 	ctx.Cuckoo = cuckoo
 
+	tr := &http.Transport{}
+	if !ctx.Config.VerifySSL {
+		tr = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	ctx.Client = &http.Client{Transport: tr, Timeout: time.Minute * 5}
+
 	// prepare routing
 	r := http.NewServeMux()
+	r.HandleFunc("/info/", HTTPInfo)
 	r.HandleFunc("/status/", HTTPStatus)
 	r.HandleFunc("/feed/", HTTPFeed)
 	r.HandleFunc("/check/", HTTPCheck)
+	r.HandleFunc("/check/batch/", HTTPCheckBatch)
 	r.HandleFunc("/results/", HTTPResults)
+	r.HandleFunc("/release/", HTTPRelease)
+	r.HandleFunc("/cancel/", HTTPCancel)
+
+	if ctx.Config.PlannerURL != "" {
+		go heartbeat()
+	}
 
 	srv := &http.Server{
 		Handler:      r,
 		Addr:         ctx.Config.HTTPBinding,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 5 * time.Minute, // samples might be uploaded or downloaded
+		ReadTimeout:  5 * time.Minute,
 	}
 
 	log.Fatal(srv.ListenAndServe())
 }
 
+// heartbeat registers the service at the planner periodically, the
+// planner forgets it once the heartbeats stop.
+func heartbeat() {
+	interval := ctx.Config.HeartbeatInterval
+	if interval <= 0 {
+		interval = 30
+	}
+
+	regJ, err := json.Marshal(&ReqRegistration{
+		Name:     "cuckoo",
+		URL:      ctx.Config.PublicURL,
+		Capacity: ctx.Config.MaxPending,
+	})
+	if err != nil {
+		log.Println("Could not encode registration:", err.Error())
+		return
+	}
+
+	for {
+		req, err := http.NewRequest("POST", strings.TrimRight(ctx.Config.PlannerURL, "/")+"/register/", bytes.NewReader(regJ))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+ctx.Config.RegistrationToken)
+
+			var resp *http.Response
+			resp, err = ctx.Client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 300 {
+					err = errors.New(resp.Status)
+				}
+			}
+		}
+
+		if err != nil {
+			log.Println("Registering at the planner failed:", err.Error())
+		}
+
+		time.Sleep(time.Second * time.Duration(interval))
+	}
+}
+
+func HTTPInfo(w http.ResponseWriter, r *http.Request) {
+	resp := &RespInfo{
+		Name:            "cuckoo",
+		ProtocolVersion: 1,
+		ObjectTypes:     []string{"file"},
+		AcceptedTypes:   ctx.Config.AcceptedTypes,
+		Options:         []string{},
+		Features:        []string{"batch-check", "callbacks", "cancel", "release"},
+	}
+
+	for option := range allowedOptions {
+		resp.Options = append(resp.Options, option)
+	}
+	sort.Strings(resp.Options)
+
+	// the version is informational, the info is sent without it
+	if s, err := ctx.Cuckoo.GetStatus(); err == nil {
+		resp.Version = s.Version
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
 func HTTPStatus(w http.ResponseWriter, r *http.Request) {
 	resp := &RespStatus{
 		Degraded:  false,
 		Error:     "",
 		FreeSlots: 0,
+		Delivery:  []string{"shared", "url", "upload"},
+		Callbacks: true,
+
+		AcceptedTypes: ctx.Config.AcceptedTypes,
 	}
 
 	s, err := ctx.Cuckoo.GetStatus()
@@ -134,23 +302,36 @@ func HTTPFeed(w http.ResponseWriter, r *http.Request) {
 		TaskID: "",
 	}
 
-	sample := r.URL.Query().Get("obj")
+	sample := r.FormValue("obj")
 	if sample == "" {
 		resp.Error = "No sample given"
 		HTTP500(w, r, resp)
 		return
 	}
 
-	sampleBytes, err := ioutil.ReadFile("/tmp/" + sample)
+	sampleBytes, err := readSample(r, sample)
 	if err != nil {
 		resp.Error = err.Error()
 		HTTP500(w, r, resp)
 		return
 	}
 
-	// TODO: actually fill payload, but therefore the payload
-	// has to be send by totem-dyn in the first place.
 	payload := make(map[string]string)
+	if optionsJ := r.FormValue("options"); optionsJ != "" {
+		if err := json.Unmarshal([]byte(optionsJ), &payload); err != nil {
+			resp.Error = "Could not decode options: " + err.Error()
+			HTTP500(w, r, resp)
+			return
+		}
+	}
+
+	for key := range payload {
+		if !allowedOptions[key] {
+			resp.Error = "Unsupported option " + key
+			HTTP500(w, r, resp)
+			return
+		}
+	}
 
 	taskID, err := ctx.Cuckoo.NewTask(sampleBytes, sample, payload)
 	if err != nil {
@@ -160,10 +341,133 @@ func HTTPFeed(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp.TaskID = strconv.Itoa(taskID)
+	resp.Options = payload
+
+	if callback := r.FormValue("callback"); callback != "" {
+		go watchTask(taskID, callback)
+	}
 
 	json.NewEncoder(w).Encode(resp)
 }
 
+// readSample gets the sample bytes either from the uploaded file,
+// by downloading it from the planner or from the shared /tmp.
+func readSample(r *http.Request, sample string) ([]byte, error) {
+	if r.Method == "POST" {
+		f, _, err := r.FormFile("sample")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return ioutil.ReadAll(f)
+	}
+
+	if sampleURL := r.FormValue("url"); sampleURL != "" {
+		dl, err := ctx.Client.Get(sampleURL)
+		if err != nil {
+			return nil, err
+		}
+		defer dl.Body.Close()
+
+		if dl.StatusCode != 200 {
+			return nil, errors.New("Downloading the sample failed: " + dl.Status)
+		}
+
+		return ioutil.ReadAll(dl.Body)
+	}
+
+	if sample != filepath.Base(sample) {
+		return nil, errors.New("Invalid sample name")
+	}
+
+	return ioutil.ReadFile("/tmp/" + sample)
+}
+
+// watchTask waits for a task to be reported or to fail and notifies
+// the planner at callback. Watches are not persisted, the planner
+// falls back to polling if a notification never arrives.
+func watchTask(taskID int, callback string) {
+	s, err := waitForEnd(taskID)
+	switch {
+	case err != nil:
+		log.Println("Watching task", strconv.Itoa(taskID), "failed:", err.Error())
+		notify(callback, &ReqCallback{Error: "Watching the task failed: " + err.Error()})
+	case s == "reported":
+		notify(callback, &ReqCallback{Done: true})
+	default:
+		notify(callback, &ReqCallback{Error: "Task " + s})
+	}
+}
+
+// status checks of a watched task which may fail in a row before
+// the watch is given up
+const maxWatchErrors = 10
+
+// waitForEnd checks the status of a task every CallbackInterval
+// seconds until it was reported or failed and returns that status.
+// It gives up after WatchTimeout seconds (default a day) or after
+// maxWatchErrors failed status checks in a row.
+func waitForEnd(taskID int) (string, error) {
+	interval := ctx.Config.CallbackInterval
+	if interval <= 0 {
+		interval = 10
+	}
+
+	timeout := ctx.Config.WatchTimeout
+	if timeout <= 0 {
+		timeout = 86400
+	}
+
+	deadline := time.Now().Add(time.Second * time.Duration(timeout))
+	failed := 0
+
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second * time.Duration(interval))
+
+		s, err := ctx.Cuckoo.TaskStatus(taskID)
+		if err != nil {
+			failed++
+			if failed >= maxWatchErrors {
+				return "", errors.New("status unavailable after " + strconv.Itoa(failed) + " tries: " + err.Error())
+			}
+
+			log.Println("Checking the status of task", strconv.Itoa(taskID), "failed:", err.Error())
+			continue
+		}
+		failed = 0
+
+		if s == "reported" || strings.HasPrefix(s, "failed") {
+			return s, nil
+		}
+	}
+
+	return "", errors.New("task did not end within " + strconv.Itoa(timeout) + " seconds")
+}
+
+// notify posts cb to the callback url, retrying a few times.
+func notify(callback string, cb *ReqCallback) {
+	cbJ, err := json.Marshal(cb)
+	if err != nil {
+		log.Println("Could not encode callback:", err.Error())
+		return
+	}
+
+	for try := 1; try <= 3; try++ {
+		resp, err := ctx.Client.Post(callback, "application/json", bytes.NewReader(cbJ))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+
+		log.Println("Notifying", callback, "failed:", err.Error())
+		time.Sleep(time.Second * time.Duration(try*10))
+	}
+}
+
 func HTTPCheck(w http.ResponseWriter, r *http.Request) {
 	resp := &RespCheckTask{
 		Error: "",
@@ -185,7 +489,87 @@ func HTTPCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp.Done = (s == "reported")
+	setState(resp, s)
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+// setState translates the status of a cuckoo task into the state
+// of the service protocol.
+func setState(resp *RespCheckTask, status string) {
+	resp.Done = (status == "reported")
+
+	switch {
+	case status == "pending":
+		resp.State = "queued"
+	case status == "running":
+		resp.State = "running"
+	case status == "completed":
+		// the analysis is over, cuckoo is processing the report
+		resp.State = "processing"
+	case status == "reported":
+		resp.State = "done"
+	case strings.HasPrefix(status, "failed"):
+		resp.State = "failed"
+		resp.Message = "Task " + status
+	default:
+		resp.State = "running"
+		resp.Message = "Task " + status
+	}
+}
+
+func HTTPCheckBatch(w http.ResponseWriter, r *http.Request) {
+	resp := &RespCheckBatch{
+		Error: "",
+		Tasks: make(map[string]*RespCheckTask),
+	}
+
+	taskIDsStr := r.URL.Query().Get("taskids")
+	if taskIDsStr == "" {
+		resp.Error = "No taskIDs given"
+		HTTP500(w, r, resp)
+		return
+	}
+
+	limit := ctx.Config.BatchListLimit
+	if limit <= 0 {
+		limit = 1000
+	}
+
+	// one call for all recent tasks instead of one per task
+	tasks, err := ctx.Cuckoo.TaskList(limit)
+	if err != nil {
+		resp.Error = err.Error()
+		HTTP500(w, r, resp)
+		return
+	}
+
+	status := make(map[int]string)
+	for _, t := range tasks {
+		status[t.Id] = t.Status
+	}
+
+	for _, taskIDstr := range strings.Split(taskIDsStr, ",") {
+		taskResp := &RespCheckTask{}
+		resp.Tasks[taskIDstr] = taskResp
+
+		taskID, err := strconv.Atoi(taskIDstr)
+		if err != nil {
+			taskResp.Error = "Invalid taskID"
+			continue
+		}
+
+		s, ok := status[taskID]
+		if !ok {
+			s, err = ctx.Cuckoo.TaskStatus(taskID)
+			if err != nil {
+				taskResp.Error = err.Error()
+				continue
+			}
+		}
+
+		setState(taskResp, s)
+	}
 
 	json.NewEncoder(w).Encode(resp)
 }
@@ -240,13 +624,93 @@ func HTTPResults(w http.ResponseWriter, r *http.Request) {
 		resStructs = append(resStructs, dResStructs...)
 	*/
 
-	if err = ctx.Cuckoo.DeleteTask(taskID); err != nil {
+	// the version is informational, results are sent without it
+	if status, err := ctx.Cuckoo.GetStatus(); err == nil {
+		resp.Version = status.Version
+	}
+
+	// the task is kept until the planner released it, so the results
+	// can be fetched again if publishing them failed
+	resp.Results = resStructs
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+func HTTPRelease(w http.ResponseWriter, r *http.Request) {
+	resp := &RespReleaseTask{
+		Error: "",
+	}
+
+	taskIDstr := r.URL.Query().Get("taskid")
+	if taskIDstr == "" {
+		resp.Error = "No taskID given"
+		HTTP500(w, r, resp)
+		return
+	}
+	taskID, _ := strconv.Atoi(taskIDstr)
+
+	if err := ctx.Cuckoo.DeleteTask(taskID); err != nil {
 		log.Println("Cleaning cuckoo up failed for task", strconv.Itoa(taskID), err.Error())
+		resp.Error = err.Error()
+		HTTP500(w, r, resp)
+		return
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+func HTTPCancel(w http.ResponseWriter, r *http.Request) {
+	resp := &RespCancelTask{
+		Error: "",
+	}
+
+	taskIDstr := r.URL.Query().Get("taskid")
+	if taskIDstr == "" {
+		resp.Error = "No taskID given"
+		HTTP500(w, r, resp)
+		return
+	}
+	taskID, _ := strconv.Atoi(taskIDstr)
+
+	s, err := ctx.Cuckoo.TaskStatus(taskID)
+	if err != nil {
+		resp.Error = err.Error()
+		HTTP500(w, r, resp)
+		return
+	}
+
+	// cuckoo refuses to delete tasks which are analysed or processed
+	// and has no API to stop them, they are removed once they end
+	if s == "running" || s == "completed" {
+		go deleteWhenDone(taskID)
+
+		resp.Error = "Task " + s + " can't be stopped, it is deleted once the analysis ended"
+		HTTP500(w, r, resp)
+		return
+	}
+
+	if err := ctx.Cuckoo.DeleteTask(taskID); err != nil {
+		resp.Error = err.Error()
+		HTTP500(w, r, resp)
+		return
 	}
 
 	json.NewEncoder(w).Encode(resp)
 }
 
+// deleteWhenDone waits for the task to end and deletes it then. If
+// the end can't be awaited the task is left to cuckoo.
+func deleteWhenDone(taskID int) {
+	if _, err := waitForEnd(taskID); err != nil {
+		log.Println("Watching cancelled task", strconv.Itoa(taskID), "failed, it is not deleted:", err.Error())
+		return
+	}
+
+	if err := ctx.Cuckoo.DeleteTask(taskID); err != nil {
+		log.Println("Deleting cancelled task", strconv.Itoa(taskID), "failed:", err.Error())
+	}
+}
+
 func HTTP500(w http.ResponseWriter, r *http.Request, response interface{}) {
 	w.WriteHeader(http.StatusInternalServerError)
 	json.NewEncoder(w).Encode(response)
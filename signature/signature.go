@@ -0,0 +1,200 @@
+// Package signature signs the results published by Totem-Dynamic and
+// lets their consumers verify them. The signature covers the message
+// body exactly as published, i.e. after compression, and is sent
+// together with the algorithm and the ID of the key as headers.
+//
+// A consumer verifies a delivery with
+//
+//	v := signature.NewVerifier()
+//	v.AddHMACKey("planner-1", []byte("shared secret"))
+//	if err := v.VerifyDelivery(msg); err != nil {
+//		// reject the result
+//	}
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/streadway/amqp"
+)
+
+// headers carrying the signature
+const (
+	HeaderSignature = "x-totem-signature" // base64 encoded
+	HeaderAlgorithm = "x-totem-signature-algorithm"
+	HeaderKeyID     = "x-totem-key-id"
+)
+
+// supported algorithms
+const (
+	HMACSHA256 = "hmac-sha256"
+	Ed25519    = "ed25519"
+)
+
+// Signer signs result bodies with one key.
+type Signer struct {
+	algorithm string
+	keyID     string
+	hmacKey   []byte
+	private   ed25519.PrivateKey
+}
+
+// NewSigner returns a Signer for the given algorithm. For HMACSHA256
+// key is the shared key, for Ed25519 the base64 encoded private key
+// or its 32 byte seed.
+func NewSigner(algorithm, key, keyID string) (*Signer, error) {
+	if key == "" {
+		return nil, errors.New("No signing key given")
+	}
+
+	s := &Signer{algorithm: algorithm, keyID: keyID}
+
+	switch algorithm {
+	case HMACSHA256:
+		s.hmacKey = []byte(key)
+	case Ed25519:
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch len(raw) {
+		case ed25519.SeedSize:
+			s.private = ed25519.NewKeyFromSeed(raw)
+		case ed25519.PrivateKeySize:
+			s.private = ed25519.PrivateKey(raw)
+		default:
+			return nil, errors.New("Invalid ed25519 private key size")
+		}
+	default:
+		return nil, errors.New("Unknown signing algorithm " + algorithm)
+	}
+
+	return s, nil
+}
+
+// PublicKey returns the public key of an Ed25519 signer, nil for HMAC.
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	if s.private == nil {
+		return nil
+	}
+
+	return s.private.Public().(ed25519.PublicKey)
+}
+
+// Sign returns the headers carrying the signature of body.
+func (s *Signer) Sign(body []byte) map[string]string {
+	var sig []byte
+
+	switch s.algorithm {
+	case HMACSHA256:
+		mac := hmac.New(sha256.New, s.hmacKey)
+		mac.Write(body)
+		sig = mac.Sum(nil)
+	case Ed25519:
+		sig = ed25519.Sign(s.private, body)
+	}
+
+	return map[string]string{
+		HeaderSignature: base64.StdEncoding.EncodeToString(sig),
+		HeaderAlgorithm: s.algorithm,
+		HeaderKeyID:     s.keyID,
+	}
+}
+
+// Verifier checks signatures against the keys it knows, keyed by
+// their IDs.
+type Verifier struct {
+	hmacKeys   map[string][]byte
+	publicKeys map[string]ed25519.PublicKey
+}
+
+// NewVerifier returns a Verifier without any keys.
+func NewVerifier() *Verifier {
+	return &Verifier{
+		hmacKeys:   make(map[string][]byte),
+		publicKeys: make(map[string]ed25519.PublicKey),
+	}
+}
+
+// AddHMACKey adds a shared key for HMACSHA256 signatures.
+func (v *Verifier) AddHMACKey(keyID string, key []byte) {
+	v.hmacKeys[keyID] = key
+}
+
+// AddPublicKey adds a public key for Ed25519 signatures.
+func (v *Verifier) AddPublicKey(keyID string, key ed25519.PublicKey) {
+	v.publicKeys[keyID] = key
+}
+
+// Verify checks the signature in headers against body. An error is
+// returned if the body is unsigned, the key is unknown or the
+// signature does not match.
+func (v *Verifier) Verify(body []byte, headers map[string]string) error {
+	encoded := headers[HeaderSignature]
+	if encoded == "" {
+		return errors.New("Result is not signed")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+
+	keyID := headers[HeaderKeyID]
+
+	switch headers[HeaderAlgorithm] {
+	case HMACSHA256:
+		key, ok := v.hmacKeys[keyID]
+		if !ok {
+			return errors.New("Unknown key " + keyID)
+		}
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("Signature does not match")
+		}
+	case Ed25519:
+		key, ok := v.publicKeys[keyID]
+		if !ok {
+			return errors.New("Unknown key " + keyID)
+		}
+
+		if !ed25519.Verify(key, body, sig) {
+			return errors.New("Signature does not match")
+		}
+	default:
+		return errors.New("Unknown signing algorithm " + headers[HeaderAlgorithm])
+	}
+
+	return nil
+}
+
+// VerifyHTTP checks the signature of a result posted by an http
+// result sink.
+func (v *Verifier) VerifyHTTP(body []byte, h http.Header) error {
+	return v.Verify(body, map[string]string{
+		HeaderSignature: h.Get(HeaderSignature),
+		HeaderAlgorithm: h.Get(HeaderAlgorithm),
+		HeaderKeyID:     h.Get(HeaderKeyID),
+	})
+}
+
+// VerifyDelivery checks the signature of a result received from the
+// results exchange.
+func (v *Verifier) VerifyDelivery(msg amqp.Delivery) error {
+	headers := make(map[string]string)
+	for key, val := range msg.Headers {
+		if s, ok := val.(string); ok {
+			headers[key] = s
+		}
+	}
+
+	return v.Verify(msg.Body, headers)
+}
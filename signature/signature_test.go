@@ -0,0 +1,135 @@
+package signature
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+var seed = base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))
+
+func newVerifier(s *Signer) *Verifier {
+	v := NewVerifier()
+	v.AddHMACKey("hmac-1", []byte("shared secret"))
+	if pub := s.PublicKey(); pub != nil {
+		v.AddPublicKey("ed-1", pub)
+	}
+
+	return v
+}
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"service":"cuckoo","data":{}}`)
+
+	tests := []struct {
+		name      string
+		algorithm string
+		key       string
+		keyID     string
+		tamper    func(body []byte, headers map[string]string) []byte
+		ok        bool
+	}{
+		{"hmac", HMACSHA256, "shared secret", "hmac-1", nil, true},
+		{"ed25519", Ed25519, seed, "ed-1", nil, true},
+		{"hmac body changed", HMACSHA256, "shared secret", "hmac-1", func(b []byte, h map[string]string) []byte {
+			return append(b, ' ')
+		}, false},
+		{"ed25519 body changed", Ed25519, seed, "ed-1", func(b []byte, h map[string]string) []byte {
+			c := append([]byte{}, b...)
+			c[0] = '['
+			return c
+		}, false},
+		{"hmac wrong key", HMACSHA256, "other secret", "hmac-1", nil, false},
+		{"unknown key id", HMACSHA256, "shared secret", "hmac-2", nil, false},
+		{"signature removed", HMACSHA256, "shared secret", "hmac-1", func(b []byte, h map[string]string) []byte {
+			delete(h, HeaderSignature)
+			return b
+		}, false},
+		{"signature garbled", Ed25519, seed, "ed-1", func(b []byte, h map[string]string) []byte {
+			h[HeaderSignature] = "not base64!"
+			return b
+		}, false},
+		{"algorithm swapped", HMACSHA256, "shared secret", "hmac-1", func(b []byte, h map[string]string) []byte {
+			h[HeaderAlgorithm] = Ed25519
+			return b
+		}, false},
+		{"algorithm unknown", HMACSHA256, "shared secret", "hmac-1", func(b []byte, h map[string]string) []byte {
+			h[HeaderAlgorithm] = "none"
+			return b
+		}, false},
+	}
+
+	for _, tt := range tests {
+		s, err := NewSigner(tt.algorithm, tt.key, tt.keyID)
+		if err != nil {
+			t.Fatalf("%s: NewSigner: %s", tt.name, err)
+		}
+
+		headers := s.Sign(body)
+		signed := body
+		if tt.tamper != nil {
+			signed = tt.tamper(body, headers)
+		}
+
+		err = newVerifier(s).Verify(signed, headers)
+		if tt.ok && err != nil {
+			t.Errorf("%s: expected a valid signature, got %s", tt.name, err)
+		}
+
+		if !tt.ok && err == nil {
+			t.Errorf("%s: expected the signature to be rejected", tt.name)
+		}
+	}
+}
+
+func TestNewSignerErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		key       string
+	}{
+		{"no key", HMACSHA256, ""},
+		{"unknown algorithm", "rsa", "key"},
+		{"ed25519 not base64", Ed25519, "not base64!"},
+		{"ed25519 wrong size", Ed25519, base64.StdEncoding.EncodeToString([]byte("short"))},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewSigner(tt.algorithm, tt.key, "id"); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestVerifyTransports(t *testing.T) {
+	body := []byte("compressed body")
+
+	s, err := NewSigner(Ed25519, seed, "ed-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := s.Sign(body)
+	v := newVerifier(s)
+
+	h := http.Header{}
+	table := amqp.Table{}
+	for key, val := range headers {
+		h.Set(key, val)
+		table[key] = val
+	}
+
+	if err := v.VerifyHTTP(body, h); err != nil {
+		t.Errorf("VerifyHTTP: %s", err)
+	}
+
+	if err := v.VerifyDelivery(amqp.Delivery{Headers: table, Body: body}); err != nil {
+		t.Errorf("VerifyDelivery: %s", err)
+	}
+
+	if err := v.VerifyDelivery(amqp.Delivery{Headers: table, Body: []byte("other body")}); err == nil {
+		t.Error("VerifyDelivery accepted a tampered body")
+	}
+}
@@ -0,0 +1,92 @@
+package submit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// reference to a result payload which was too large to be published
+// and was put into the results store instead
+type DataRef struct {
+	Location        string `json:"location"`
+	SHA256          string `json:"sha256"` // of the stored, possibly compressed, payload
+	Size            int    `json:"size"`   // of the stored payload
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+// compress encodes data with the given content encoding, an empty
+// encoding returns data unchanged.
+func compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case "gzip":
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case "zstd":
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+
+		return w.EncodeAll(data, nil), nil
+	}
+
+	return nil, errors.New("Unknown result compression " + encoding)
+}
+
+// fileExtension returns the extension of payloads stored with the
+// given content encoding.
+func fileExtension(encoding string) string {
+	switch encoding {
+	case "gzip":
+		return ".json.gz"
+	case "zstd":
+		return ".json.zst"
+	}
+
+	return ".json"
+}
+
+// offload puts the result payload into the results store and
+// returns a reference to it.
+func (c *sCtx) offload(name string, data []byte) (*DataRef, error) {
+	if c.ResultStore == nil {
+		return nil, errors.New("Result exceeds ResultOffloadSize but no ResultStore is configured")
+	}
+
+	payload, err := compress(c.Config.ResultCompression, data)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(payload)
+	hashString := hex.EncodeToString(hash[:])
+
+	location, err := c.ResultStore.Put(name+"-"+hashString+fileExtension(c.Config.ResultCompression), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataRef{
+		Location:        location,
+		SHA256:          hashString,
+		Size:            len(payload),
+		ContentEncoding: c.Config.ResultCompression,
+	}, nil
+}
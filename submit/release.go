@@ -0,0 +1,190 @@
+package submit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+// bucket of the store holding the fetched results until they were
+// sent, the results themselves are kept in a file in the workspace
+const resultsBucket = "results"
+
+// how long fetched results are kept if their task never finishes,
+// e.g. because its message went to the failed queue
+const resultsRetention = 7 * 24 * time.Hour
+
+// results of a task as fetched from the service
+type fetchedResults struct {
+	Results      *lib.TaskResults `json:"-"` // loaded from ResultsPath
+	ResultsPath  string
+	FetchStarted time.Time
+	Fetched      time.Time
+	Delivered    []string // names of the sinks which took the result over
+}
+
+// delivered checks if the sink took the result over already.
+func (f *fetchedResults) delivered(sink string) bool {
+	for _, name := range f.Delivered {
+		if name == sink {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fetchResults returns the results of the task. Results are fetched
+// from the service only once and kept in the workspace, a redelivered
+// message reuses them. The service keeps the task until it is
+// released after the results were sent.
+func (c *sCtx) fetchResults(req *lib.InternalRequest) (*fetchedResults, error) {
+	fetched := &fetchedResults{}
+
+	found, err := c.Store.Get(resultsBucket, req.Key(), fetched)
+	if err != nil {
+		c.Warning.Println("Could not read stored results of task", req.TaskID+":", err.Error())
+	} else if found {
+		fetched.Results, err = loadResults(fetched.ResultsPath)
+		if err == nil {
+			c.Info.Println("Reusing stored results of task", req.TaskID, "at", req.URL)
+			return fetched, nil
+		}
+
+		c.Warning.Println("Could not load stored results of task", req.TaskID+":", err.Error())
+		c.RemoveFile(fetched.ResultsPath)
+		fetched = &fetchedResults{}
+	}
+
+	service := c.NewService(req.Service, req.URL)
+
+	fetched.FetchStarted = time.Now()
+	fetched.Results, err = service.TaskResults(req.TaskID)
+	if err != nil {
+		return nil, err
+	}
+	fetched.Fetched = time.Now()
+
+	// without the stored copy the results are fetched again
+	fetched.ResultsPath, err = storeResults(fetched.Results)
+	if err != nil {
+		c.Warning.Println("Could not store results of task", req.TaskID+":", err.Error())
+		return fetched, nil
+	}
+
+	if err := c.Store.Put(resultsBucket, req.Key(), fetched); err != nil {
+		c.Warning.Println("Could not store results of task", req.TaskID+":", err.Error())
+		c.RemoveFile(fetched.ResultsPath)
+		fetched.ResultsPath = ""
+	}
+
+	return fetched, nil
+}
+
+// storeResults writes the results to a new file in the workspace and
+// returns its path.
+func storeResults(results *lib.TaskResults) (string, error) {
+	f, err := ioutil.TempFile("/tmp/", "totem-dynamic")
+	if err != nil {
+		return "", err
+	}
+
+	err = json.NewEncoder(f).Encode(results)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// loadResults reads results written by storeResults.
+func loadResults(path string) (*lib.TaskResults, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	results := &lib.TaskResults{}
+	return results, json.NewDecoder(f).Decode(results)
+}
+
+// resultFiles returns the files of all stored results, so the
+// janitor keeps them.
+func (c *sCtx) resultFiles() []string {
+	files := []string{}
+
+	c.Store.ForEach(resultsBucket, func(key string, value []byte) error {
+		fetched := &fetchedResults{}
+		if err := json.Unmarshal(value, fetched); err == nil && fetched.ResultsPath != "" {
+			files = append(files, fetched.ResultsPath)
+		}
+
+		return nil
+	})
+
+	return files
+}
+
+// release tells the service that the results of the task were taken
+// over and drops the stored copy.
+func (c *sCtx) release(req *lib.InternalRequest) {
+	if c.ServiceSupports(req.Service, req.URL, lib.FeatureRelease) {
+		service := c.NewService(req.Service, req.URL)
+		if err := service.ReleaseTask(req.TaskID); err != nil {
+			c.Warning.Println("Releasing task", req.TaskID, "at", req.URL, "failed:", err.Error())
+		}
+	}
+
+	c.dropResults(req)
+}
+
+// dropResults removes the stored results of the task.
+func (c *sCtx) dropResults(req *lib.InternalRequest) {
+	fetched := &fetchedResults{}
+	if found, err := c.Store.Get(resultsBucket, req.Key(), fetched); err == nil && found {
+		c.RemoveFile(fetched.ResultsPath)
+	}
+
+	if err := c.Store.Delete(resultsBucket, req.Key()); err != nil {
+		c.Warning.Println("Could not remove stored results of task", req.TaskID+":", err.Error())
+	}
+}
+
+// pruneResults removes stored results older than the retention every
+// hour, it never returns.
+func (c *sCtx) pruneResults() {
+	for {
+		old := []string{}
+		files := []string{}
+
+		c.Store.ForEach(resultsBucket, func(key string, value []byte) error {
+			fetched := &fetchedResults{}
+			if err := json.Unmarshal(value, fetched); err != nil || time.Since(fetched.Fetched) > resultsRetention {
+				old = append(old, key)
+				files = append(files, fetched.ResultsPath)
+			}
+
+			return nil
+		})
+
+		for i, key := range old {
+			c.Warning.Println("Dropping stored results of", key, "which were never sent")
+			c.RemoveFile(files[i])
+
+			if err := c.Store.Delete(resultsBucket, key); err != nil {
+				c.Warning.Println("Could not remove stored results:", err.Error())
+			}
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
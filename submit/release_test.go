@@ -0,0 +1,60 @@
+package submit
+
+import (
+	"os"
+	"testing"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+func TestFetchResultsReusesStoredResults(t *testing.T) {
+	server, calls := newTestService(t)
+	c := newTestContext(t)
+	req := &lib.InternalRequest{Service: "cuckoo", URL: server.URL, TaskID: "1"}
+
+	first, err := c.fetchResults(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.dropResults(req)
+
+	// a redelivered message gets the stored results
+	again, err := c.fetchResults(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls["results"] != 1 {
+		t.Errorf("expected the results to be fetched once, got %d", calls["results"])
+	}
+
+	if again.ResultsPath != first.ResultsPath || !again.Fetched.Equal(first.Fetched) {
+		t.Errorf("expected the stored results %+v, got %+v", first, again)
+	}
+
+	if results, ok := again.Results.Results.(map[string]interface{}); !ok || results["verdict"] != "malicious" {
+		t.Errorf("expected the stored results to be loaded, got %v", again.Results.Results)
+	}
+
+	// lost results are fetched again
+	if err := os.Remove(first.ResultsPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.fetchResults(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls["results"] != 2 {
+		t.Errorf("expected lost results to be fetched again, got %d fetches", calls["results"])
+	}
+
+	// dropped results are gone with their file
+	fetched := &fetchedResults{}
+	c.Store.Get(resultsBucket, req.Key(), fetched)
+	c.dropResults(req)
+
+	if _, err := os.Stat(fetched.ResultsPath); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", fetched.ResultsPath)
+	}
+}
@@ -0,0 +1,317 @@
+package submit
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+
+	"github.com/streadway/amqp"
+)
+
+// sink takes over finished results, e.g. by publishing them
+type sink interface {
+	Send(out *output) error
+}
+
+// finished result as it is handed to the sinks
+type output struct {
+	Result   *Result
+	JSON     []byte            // the encoded result
+	Body     []byte            // JSON compressed with Encoding
+	Encoding string            // the configured ResultCompression
+	Headers  map[string]string // signature of Body, if signing is enabled
+}
+
+// configured sink together with its filters
+type resultSink struct {
+	sink
+	name string
+	conf *lib.ResultSinkConfig
+}
+
+// setupSinks creates the configured result sinks. Without any the
+// results are published on the "totem" exchange like before.
+func (c *sCtx) setupSinks() error {
+	confs := c.Config.ResultSinks
+	if len(confs) == 0 {
+		confs = []*lib.ResultSinkConfig{{Type: "amqp", Required: true}}
+	}
+
+	for i, conf := range confs {
+		var s sink
+
+		switch conf.Type {
+		case "amqp":
+			exchange := conf.Exchange
+			if exchange == "" {
+				exchange = "totem"
+			}
+
+			s = &amqpSink{c.Producer, exchange, conf.RoutingKey}
+		case "http":
+			if conf.URL == "" {
+				return errors.New("URL is missing for http result sink " + strconv.Itoa(i))
+			}
+
+			s = &httpSink{
+				client:    c.Client,
+				url:       conf.URL,
+				headers:   conf.Headers,
+				retries:   conf.Retries,
+				retryWait: time.Second * time.Duration(conf.RetryWait),
+			}
+		case "file":
+			if conf.Path == "" {
+				return errors.New("Path is missing for file result sink " + strconv.Itoa(i))
+			}
+
+			maxFiles := conf.MaxFiles
+			if maxFiles <= 0 {
+				maxFiles = 5
+			}
+
+			s = &fileSink{path: conf.Path, maxSize: conf.MaxSize, maxFiles: maxFiles}
+		default:
+			return errors.New("Unknown result sink " + conf.Type)
+		}
+
+		c.Sinks = append(c.Sinks, &resultSink{s, conf.Type + "-" + strconv.Itoa(i), conf})
+	}
+
+	return nil
+}
+
+// send hands the result to all sinks it passes the filters of, in
+// the configured order. Every sink is tried, the failures of the
+// required ones are returned together, those of the others are only
+// logged. The sinks which took the result over are recorded with the
+// fetched results, so a retry of the task skips them.
+func (c *sCtx) send(req *lib.InternalRequest, fetched *fetchedResults, out *output) error {
+	failed := []string{}
+
+	for _, s := range c.Sinks {
+		if !s.matches(out.Result) || fetched.delivered(s.name) {
+			continue
+		}
+
+		err := s.Send(out)
+		if err == nil {
+			fetched.Delivered = append(fetched.Delivered, s.name)
+			continue
+		}
+
+		if s.conf.Required {
+			failed = append(failed, s.name+": "+err.Error())
+			continue
+		}
+
+		c.Warning.Println("Could not send result to sink", s.name+":", err.Error())
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	if err := c.Store.Put(resultsBucket, req.Key(), fetched); err != nil {
+		c.Warning.Println("Could not record the sinks of task", req.TaskID, "which took the result over:", err.Error())
+	}
+
+	return errors.New("Result sinks failed: " + strings.Join(failed, ", "))
+}
+
+// matches checks if the result passes all filters of the sink.
+func (s *resultSink) matches(res *Result) bool {
+	return matchAny(s.conf.Services, res.ServiceName) &&
+		matchAny(s.conf.Sources, res.Source) &&
+		matchAny(s.conf.Tags, res.Tags...)
+}
+
+// matchAny checks if one of the values is in filter, an empty filter
+// matches everything.
+func matchAny(filter []string, values ...string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	for _, f := range filter {
+		for _, v := range values {
+			if f == v {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// amqpSink publishes the results on an exchange, Send returns once
+// the broker confirmed them.
+type amqpSink struct {
+	producer   *lib.QueueHandler // in confirm mode
+	exchange   string
+	routingKey string
+}
+
+func (s *amqpSink) Send(out *output) error {
+	key := s.routingKey
+	if key == "" {
+		key = out.Result.ServiceName + ".result.static.totem"
+	}
+
+	var headers amqp.Table
+	if len(out.Headers) > 0 {
+		headers = amqp.Table{}
+		for k, v := range out.Headers {
+			headers[k] = v
+		}
+	}
+
+	return s.producer.Publish(s.exchange, key, amqp.Publishing{
+		Headers:         headers,
+		DeliveryMode:    amqp.Persistent,
+		ContentType:     "text/plain",
+		ContentEncoding: out.Encoding,
+		Body:            out.Body,
+	})
+}
+
+// httpSink POSTs the results to an HTTP API.
+type httpSink struct {
+	client    *http.Client
+	url       string
+	headers   map[string]string // e.g. Authorization
+	retries   int
+	retryWait time.Duration
+}
+
+func (s *httpSink) Send(out *output) error {
+	wait := s.retryWait
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := s.post(out)
+		if err == nil || attempt >= s.retries {
+			return err
+		}
+
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (s *httpSink) post(out *output) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(out.Body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if out.Encoding != "" {
+		req.Header.Set("Content-Encoding", out.Encoding)
+	}
+
+	for key, val := range out.Headers {
+		req.Header.Set(key, val)
+	}
+
+	for key, val := range s.headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer lib.SafeResponseClose(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("Posting the result returned " + resp.Status)
+	}
+
+	return nil
+}
+
+// fileSink appends the uncompressed results as json lines to a
+// local file, e.g. an archive for reprocessing.
+type fileSink struct {
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File // opened on the first result
+	size int64
+}
+
+func (s *fileSink) Send(out *output) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	line := append(append([]byte{}, out.JSON...), '\n')
+
+	if s.file != nil && s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	// the result is acknowledged right after
+	return s.file.Sync()
+}
+
+// open opens the file for appending. Must be called with the mutex held.
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate moves the file to "<path>.1", the older files one number
+// up and drops the oldest. Must be called with the mutex held.
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(s.path+"."+strconv.Itoa(i), s.path+"."+strconv.Itoa(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(s.path, s.path+".1")
+}
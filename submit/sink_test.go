@@ -0,0 +1,142 @@
+package submit
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+)
+
+// fakeSink records the results it takes over or fails.
+type fakeSink struct {
+	name string
+	fail bool
+	rec  *recorder
+}
+
+func (s *fakeSink) Send(out *output) error {
+	if s.fail {
+		return errors.New(s.name + " is down")
+	}
+
+	s.rec.record(s.name)
+	return nil
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name      string
+		failing   []string // sinks which fail
+		delivered []string // sinks which took the result over before
+		ok        bool
+		events    []string
+		recorded  []string // sinks recorded as delivered
+	}{
+		{"all succeed", nil, nil, true, []string{"required", "optional", "filtered"}, []string{"required-0", "optional-1", "filtered-2"}},
+		{"optional fails", []string{"optional"}, nil, true, []string{"required", "filtered"}, []string{"required-0", "filtered-2"}},
+		{"required fails", []string{"required"}, nil, false, []string{"optional", "filtered"}, []string{"optional-1", "filtered-2"}},
+		{"retry skips delivered sinks", nil, []string{"optional-1", "filtered-2"}, true, []string{"required"}, []string{"optional-1", "filtered-2", "required-0"}},
+	}
+
+	for _, tt := range tests {
+		rec := &recorder{}
+
+		sinks := []*resultSink{}
+		for i, name := range []string{"required", "optional", "filtered"} {
+			fail := false
+			for _, f := range tt.failing {
+				fail = fail || f == name
+			}
+
+			conf := &lib.ResultSinkConfig{Required: name == "required"}
+			if name == "filtered" {
+				conf.Services = []string{"cuckoo"}
+			}
+
+			sinks = append(sinks, &resultSink{&fakeSink{name, fail, rec}, name + "-" + strconv.Itoa(i), conf})
+		}
+
+		c := newTestContext(t, sinks...)
+		req := &lib.InternalRequest{Service: "cuckoo", URL: "http://sandbox-1:8080", TaskID: "1"}
+		fetched := &fetchedResults{Delivered: tt.delivered}
+
+		err := c.send(req, fetched, &output{Result: &Result{ServiceName: "cuckoo"}})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected success to be %t, got %v", tt.name, tt.ok, err)
+		}
+
+		if strings.Join(rec.events, ",") != strings.Join(tt.events, ",") {
+			t.Errorf("%s: expected sends to %v, got %v", tt.name, tt.events, rec.events)
+		}
+
+		if strings.Join(fetched.Delivered, ",") != strings.Join(tt.recorded, ",") {
+			t.Errorf("%s: expected %v to be recorded as delivered, got %v", tt.name, tt.recorded, fetched.Delivered)
+		}
+
+		// the delivered sinks are kept for the redelivery of a failed result
+		stored := &fetchedResults{}
+		found, _ := c.Store.Get(resultsBucket, req.Key(), stored)
+		if found != !tt.ok || (found && len(stored.Delivered) != len(tt.recorded)) {
+			t.Errorf("%s: expected the delivered sinks to be stored only on failure, got %v", tt.name, stored.Delivered)
+		}
+	}
+
+	// filters skip sinks of other services
+	rec := &recorder{}
+	c := newTestContext(t, &resultSink{&fakeSink{name: "filtered", rec: rec}, "filtered-0", &lib.ResultSinkConfig{Services: []string{"cuckoo"}}})
+	req := &lib.InternalRequest{Service: "joe", URL: "http://sandbox-1:8080", TaskID: "1"}
+	if err := c.send(req, &fetchedResults{}, &output{Result: &Result{ServiceName: "joe"}}); err != nil || len(rec.events) != 0 {
+		t.Errorf("expected the result of another service to skip the sink, got %v, %v", rec.events, err)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	s := &fileSink{path: path, maxSize: 10, maxFiles: 2}
+
+	// every result fills a file on its own
+	for _, result := range []string{`"first"`, `"second"`, `"third"`, `"fourth"`} {
+		if err := s.Send(&output{JSON: []byte(result)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.file.Close()
+
+	files := map[string]string{
+		path:        `"fourth"`,
+		path + ".1": `"third"`,
+		path + ".2": `"second"`,
+	}
+	for file, result := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Errorf("%s: %s", filepath.Base(file), err)
+			continue
+		}
+
+		if string(data) != result+"\n" {
+			t.Errorf("%s: expected %s, got %q", filepath.Base(file), result, data)
+		}
+	}
+
+	// the oldest file is dropped
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only %d rotated files to be kept", s.maxFiles)
+	}
+
+	// a restarted sink appends to the existing file until it is full
+	s = &fileSink{path: path, maxSize: 20, maxFiles: 2}
+	if err := s.Send(&output{JSON: []byte(`"fifth"`)}); err != nil {
+		t.Fatal(err)
+	}
+	s.file.Close()
+
+	if data, _ := ioutil.ReadFile(path); string(data) != "\"fourth\"\n\"fifth\"\n" {
+		t.Errorf("expected the result to be appended, got %q", data)
+	}
+}
@@ -1,16 +1,12 @@
 package submit
 
 import (
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"os"
+	"path"
 	"time"
 
 	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/signature"
 
 	"github.com/streadway/amqp"
 )
@@ -19,33 +15,95 @@ type sCtx struct {
 	*lib.Ctx
 
 	Producer *lib.QueueHandler // the queue read by submit
+	Delayer  *lib.QueueHandler // the delay queue of submit, used while a service is rate limited
+	Sinks    []*resultSink
+	Signer   *signature.Signer // only set if ResultSigning is configured
 }
 
+// schema versions of Result, version 1 is the legacy format with
+// the service results as json string in Data
+const (
+	legacySchemaVersion = 1
+	schemaVersion       = 2
+)
+
+// result envelope published for every finished task
 type Result struct {
-	Filename         string    `json:"filename"`
-	Data             string    `json:"data"`
-	MD5              string    `json:"md5"`
-	SHA1             string    `json:"sha1"`
-	SHA256           string    `json:"sha256"`
-	ServiceName      string    `json:"service_name"`
-	Tags             []string  `json:"tags"`
-	Comment          string    `json:"comment"`
-	StartedDateTime  time.Time `json:"started_date_time"`
-	FinishedDateTime time.Time `json:"finished_date_time"`
+	SchemaVersion  int     `json:"schema_version"`
+	PlannerVersion string  `json:"planner_version"`
+	ServiceVersion string  `json:"service_version,omitempty"`
+	CorrelationID  string  `json:"correlation_id"` // the request ID
+	Source         string  `json:"source"`
+	ServiceURL     string  `json:"service_url"`
+	TaskID         string  `json:"task_id"`
+	Attempts       int     `json:"attempts"`
+	Outcome        string  `json:"outcome"`
+	Timing         *Timing `json:"timing"`
+
+	Filename         string             `json:"filename"`
+	ParentArchive    *lib.ArchiveParent `json:"parent_archive,omitempty"`
+	FileType         string             `json:"file_type"`
+	ObjectType       string             `json:"object_type"`
+	NormalizedURL    string             `json:"normalized_url,omitempty"`
+	URLSHA256        string             `json:"url_sha256,omitempty"`
+	Data             interface{}        `json:"data"`               // embedded json, a string in the legacy format
+	DataRef          *DataRef           `json:"data_ref,omitempty"` // set instead of Data for large results
+	MD5              string             `json:"md5"`
+	SHA1             string             `json:"sha1"`
+	SHA256           string             `json:"sha256"`
+	SHA512           string             `json:"sha512"`
+	SSDeep           string             `json:"ssdeep"`
+	TLSH             string             `json:"tlsh"`
+	ServiceName      string             `json:"service_name"`
+	Tags             []string           `json:"tags"`
+	Comment          string             `json:"comment"`
+	StartedDateTime  time.Time          `json:"started_date_time"`
+	FinishedDateTime time.Time          `json:"finished_date_time"`
+}
+
+// timing breakdown of a task, durations are in seconds
+type Timing struct {
+	Received     time.Time `json:"received"`      // request arrived at feed
+	Fed          time.Time `json:"fed"`           // task was created at the service
+	Done         time.Time `json:"done"`          // service reported the task as done
+	Queued       float64   `json:"queued"`        // from received to fed
+	Analysis     float64   `json:"analysis"`      // from fed to done
+	ResultsFetch float64   `json:"results_fetch"` // getting the results from the service
 }
 
 // Run starts the submit module either blocking or non-blocking.
 func Run(ctx *lib.Ctx, blocking bool) error {
-	producer, err := ctx.SetupQueue(ctx.Config.ResultsQueue) // should be "totem_output"
+	producer, err := ctx.SetupConfirmedQueue(ctx.Config.ResultsQueue) // should be "totem_output"
+	if err != nil {
+		return err
+	}
+
+	delayer, err := ctx.SetupDelayQueue("totem-dynamic-submit-" + ctx.Config.QueueSuffix)
 	if err != nil {
 		return err
 	}
 
 	c := &sCtx{
-		ctx,
-		producer,
+		Ctx:      ctx,
+		Producer: producer,
+		Delayer:  delayer,
 	}
 
+	err = c.setupSinks()
+	if err != nil {
+		return err
+	}
+
+	if ctx.Config.ResultSigning != "" {
+		c.Signer, err = signature.NewSigner(ctx.Config.ResultSigning, ctx.Config.ResultSigningKey, ctx.Config.ResultSigningKeyID)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.ReferenceFiles(c.resultFiles)
+	go c.pruneResults()
+
 	if blocking {
 		c.Consume("totem-dynamic-submit-"+ctx.Config.QueueSuffix, ctx.Config.SubmitPrefetchCount, c.parseMsg)
 	} else {
@@ -74,80 +132,194 @@ func (c *sCtx) parseMsg(msg amqp.Delivery) {
 }
 
 func (c *sCtx) submitResults(req *lib.InternalRequest, msg *amqp.Delivery) {
-	service := &lib.Service{
-		Name:   req.Service,
-		URL:    req.URL,
-		Client: c.Client,
+	// the task ends here, whatever the outcome, unless it is delayed
+	delayed := false
+	defer func() {
+		if !delayed {
+			c.RemoveFile(req.SamplePath())
+		}
+	}()
+
+	if req.OriginalRequest.Expired() {
+		c.dropResults(req)
+		c.ExpireTask(req, msg)
+		return
+	}
+
+	fetched, err := c.fetchResults(req)
+	if err == lib.ErrRateLimited {
+		delayed = c.delay(req, msg)
+		return
 	}
 
-	serviceResults, err := service.TaskResults(req.TaskID)
 	if c.NackOnError(err, "Could not get results", msg) {
 		return
 	}
+	serviceResults := fetched.Results
 
-	// TODO: check if it is still necessary to handle service results as string
 	resultsJ, err := json.Marshal(serviceResults.Results)
+	if c.NackOnError(err, "Could not encode results", msg) {
+		return
+	}
 
-	// generate the necessary hashes, differentiate between samples and urls
-	var fileBytes []byte
-	if req.OriginalRequest.Download {
-		fileBytes, err = ioutil.ReadFile("/tmp/" + req.FilePath)
-		if c.NackOnError(err, "Could not read sample file", msg) {
-			return
-		}
-	} else {
-		fileBytes = []byte("/tmp/" + req.FilePath)
+	// the hashes were computed by feed
+	hashes := req.Hashes
+	if hashes == nil {
+		hashes = &lib.Hashes{}
 	}
 
-	hSHA256 := sha256.New()
-	hSHA256.Write(fileBytes)
-	sha256String := fmt.Sprintf("%x", hSHA256.Sum(nil))
+	// samples extracted from an archive are named by their member path
+	filename := req.OriginalRequest.Filename
+	if req.Parent != nil && req.Parent.Member != "" {
+		filename = path.Base(req.Parent.Member)
+	}
 
-	hSHA1 := sha1.New()
-	hSHA1.Write(fileBytes)
-	sha1String := fmt.Sprintf("%x", hSHA1.Sum(nil))
+	// large results are kept in the results store
+	var data interface{} = json.RawMessage(resultsJ)
+	version := schemaVersion
+	if c.Config.LegacyResults {
+		data = string(resultsJ)
+		version = legacySchemaVersion
+	}
 
-	hMD5 := md5.New()
-	hMD5.Write(fileBytes)
-	md5String := fmt.Sprintf("%x", hMD5.Sum(nil))
+	var dataRef *DataRef
+	if c.Config.ResultOffloadSize > 0 && len(resultsJ) > c.Config.ResultOffloadSize {
+		dataRef, err = c.offload(req.Service+"-"+req.TaskID, resultsJ)
+		if c.NackOnError(err, "Could not offload the result", msg) {
+			return
+		}
+
+		data = nil
+		if c.Config.LegacyResults {
+			data = ""
+		}
+	}
 
 	// build the final result obj
 
-	resultMsg, err := json.Marshal(Result{
-		Filename:         req.OriginalRequest.Filename,
-		Data:             string(resultsJ),
-		MD5:              md5String,
-		SHA1:             sha1String,
-		SHA256:           sha256String,
+	result := &Result{
+		SchemaVersion:  version,
+		PlannerVersion: lib.Version,
+		ServiceVersion: serviceResults.Version,
+		CorrelationID:  req.OriginalRequest.RequestID,
+		Source:         req.OriginalRequest.Source,
+		ServiceURL:     req.URL,
+		TaskID:         req.TaskID,
+		Attempts:       req.OriginalRequest.Attempts,
+		Outcome:        lib.OutcomeSuccess,
+		Timing:         timing(req, fetched.FetchStarted, fetched.Fetched),
+
+		Filename:         filename,
+		ParentArchive:    req.Parent,
+		FileType:         req.FileType,
+		Data:             data,
+		DataRef:          dataRef,
+		ObjectType:       req.ObjectType,
+		NormalizedURL:    req.NormalizedURL,
+		URLSHA256:        req.URLHash,
+		MD5:              hashes.MD5,
+		SHA1:             hashes.SHA1,
+		SHA256:           hashes.SHA256,
+		SHA512:           hashes.SHA512,
+		SSDeep:           hashes.SSDeep,
+		TLSH:             hashes.TLSH,
 		ServiceName:      req.Service,
 		Tags:             req.OriginalRequest.Tags,
 		Comment:          req.OriginalRequest.Comment,
 		StartedDateTime:  req.Started,
 		FinishedDateTime: time.Now(),
-	})
+	}
 
+	resultMsg, err := json.Marshal(result)
 	if c.NackOnError(err, "Could not marshal final result", msg) {
 		return
 	}
 
-	c.Producer.Channel.Publish(
-		"totem", // exchange
-		req.Service+".result.static.totem", // routing key
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "text/plain",
-			Body:         resultMsg,
-		},
-	)
+	body, err := compress(c.Config.ResultCompression, resultMsg)
+	if c.NackOnError(err, "Could not compress final result", msg) {
+		return
+	}
+
+	// fetching the results might have taken a while
+	if req.OriginalRequest.Expired() {
+		c.dropResults(req)
+		c.ExpireTask(req, msg)
+		return
+	}
+
+	if cr := c.Cancelled(req.OriginalRequest, req.Service, req.SampleHashes()...); cr != nil {
+		c.dropResults(req)
+		c.CancelTask(req, cr, msg)
+		return
+	}
+
+	// the signature covers the body as published
+	var headers map[string]string
+	if c.Signer != nil {
+		headers = c.Signer.Sign(body)
+	}
+
+	err = c.send(req, fetched, &output{
+		Result:   result,
+		JSON:     resultMsg,
+		Body:     body,
+		Encoding: c.Config.ResultCompression,
+		Headers:  headers,
+	})
+	if c.NackOnError(err, "Could not send final result", msg) {
+		return
+	}
 
 	if err := msg.Ack(false); err != nil {
 		c.Warning.Println("Sending ACK failed!", err.Error())
 	}
 
-	// cleanup time
-	if err := os.Remove("/tmp/" + req.FilePath); err != nil {
-		c.Warning.Printf("Could not delete file %s: %s\n", req.FilePath, err.Error())
+	c.release(req)
+}
+
+// delay sends the task back to submit once the rate limits of its
+// service allow fetching the results and acks msg, the sample stays
+// claimed for it. It reports whether the task was handed over.
+func (c *sCtx) delay(req *lib.InternalRequest, msg *amqp.Delivery) bool {
+	err := c.HandOverFile(req.SamplePath())
+	if err == nil {
+		err = c.Delayer.SendDelayed(msg.Body, c.NewService(req.Service, req.URL).Delay())
 	}
+
+	if c.NackOnError(err, "Could not delay the task", msg) {
+		return false
+	}
+
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
+	}
+
+	return true
+}
+
+// timing returns the timing breakdown of a task whose results were
+// fetched between fetchStarted and fetched.
+func timing(req *lib.InternalRequest, fetchStarted, fetched time.Time) *Timing {
+	t := &Timing{
+		Received:     req.OriginalRequest.Received,
+		Fed:          req.Started,
+		Done:         fetchStarted,
+		ResultsFetch: fetched.Sub(fetchStarted).Seconds(),
+	}
+
+	// check recorded when the service reported the task as done
+	for _, state := range req.States {
+		if state.State == lib.StateDone {
+			t.Done = state.Time
+			break
+		}
+	}
+
+	if !t.Received.IsZero() {
+		t.Queued = t.Fed.Sub(t.Received).Seconds()
+	}
+
+	t.Analysis = t.Done.Sub(t.Fed).Seconds()
+
+	return t
 }
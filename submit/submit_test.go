@@ -0,0 +1,128 @@
+package submit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/HolmesProcessing/Holmes-Totem-Dynamic/lib"
+
+	"github.com/streadway/amqp"
+)
+
+func newTestContext(t *testing.T, sinks ...*resultSink) *sCtx {
+	store, err := lib.OpenStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	discard := log.New(ioutil.Discard, "", 0)
+	return &sCtx{
+		Ctx: &lib.Ctx{
+			Config:  &lib.Config{},
+			Debug:   discard,
+			Info:    discard,
+			Warning: discard,
+			Client:  http.DefaultClient,
+			Store:   store,
+		},
+		Sinks: sinks,
+	}
+}
+
+// newTestService starts a service named cuckoo which counts how often
+// the results of a task were fetched and released.
+func newTestService(t *testing.T) (*httptest.Server, map[string]int) {
+	mutex := sync.Mutex{}
+	calls := make(map[string]int)
+	count := func(endpoint string) {
+		mutex.Lock()
+		calls[endpoint]++
+		mutex.Unlock()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&lib.Info{Name: "cuckoo", ProtocolVersion: lib.ProtocolVersion, Features: []string{lib.FeatureRelease}})
+	})
+	mux.HandleFunc("/results/", func(w http.ResponseWriter, r *http.Request) {
+		count("results")
+		json.NewEncoder(w).Encode(&lib.TaskResults{Results: map[string]string{"verdict": "malicious"}})
+	})
+	mux.HandleFunc("/release/", func(w http.ResponseWriter, r *http.Request) {
+		count("release")
+		json.NewEncoder(w).Encode(&lib.ReleaseTask{})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server, calls
+}
+
+// recorder records the results sent to fake sinks and the
+// acknowledgements of deliveries in the order they happened.
+type recorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *recorder) record(event string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) Ack(tag uint64, multiple bool) error {
+	r.record("ack")
+	return nil
+}
+
+func (r *recorder) Nack(tag uint64, multiple, requeue bool) error {
+	r.record("nack")
+	return nil
+}
+
+func (r *recorder) Reject(tag uint64, requeue bool) error {
+	r.record("reject")
+	return nil
+}
+
+func TestSubmitAcksAfterSinks(t *testing.T) {
+	server, calls := newTestService(t)
+	rec := &recorder{}
+
+	c := newTestContext(t,
+		&resultSink{&fakeSink{name: "archive", rec: rec}, "file-0", &lib.ResultSinkConfig{Required: true}},
+		&resultSink{&fakeSink{name: "api", rec: rec}, "http-1", &lib.ResultSinkConfig{Required: true}},
+	)
+
+	req := &lib.InternalRequest{
+		Service:         "cuckoo",
+		URL:             server.URL,
+		TaskID:          "1",
+		OriginalRequest: &lib.ExternalRequest{},
+	}
+
+	c.submitResults(req, &amqp.Delivery{Acknowledger: rec})
+
+	if strings.Join(rec.events, ",") != "archive,api,ack" {
+		t.Errorf("expected the result to be acked after all sinks took it over, got %v", rec.events)
+	}
+
+	if calls["release"] != 1 {
+		t.Errorf("expected the task to be released once, got %d", calls["release"])
+	}
+
+	if found, _ := c.Store.Get(resultsBucket, req.Key(), &fetchedResults{}); found {
+		t.Error("expected the stored results to be dropped once the task is released")
+	}
+}